@@ -0,0 +1,132 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// album is a Telegram media group whose messages are being buffered
+type album struct {
+	messages []Message
+	timer    *time.Timer
+}
+
+var albums = make(map[string]*album)
+var albumsLock sync.Mutex
+
+func albumWindow() time.Duration {
+	if config.Telegram.AlbumWindow > 0 {
+		return time.Duration(config.Telegram.AlbumWindow) * time.Millisecond
+	}
+	return 2 * time.Second
+}
+
+// bufferAlbum adds the message to its album. The album is relayed to IRC
+// when no new messages have been added to it within the album window.
+func bufferAlbum(message Message) {
+	albumsLock.Lock()
+	defer albumsLock.Unlock()
+
+	id := message.MediaGroupID
+	buf, ok := albums[id]
+	if ok && !buf.timer.Stop() {
+		// The timer has already fired and the album is being flushed, so start a new one
+		ok = false
+	}
+	if !ok {
+		buf = &album{}
+		current := buf
+		buf.timer = time.AfterFunc(albumWindow(), func() {
+			flushAlbum(id, current)
+		})
+		albums[id] = buf
+	} else {
+		buf.timer.Reset(albumWindow())
+	}
+	buf.messages = append(buf.messages, message)
+}
+
+// flushAlbum uploads the files in the album and relays them to IRC as a single line
+func flushAlbum(id string, buf *album) {
+	albumsLock.Lock()
+	// A newer buffer for the same media group may have replaced this one
+	if albums[id] == buf {
+		delete(albums, id)
+	}
+	albumsLock.Unlock()
+	if len(buf.messages) == 0 {
+		return
+	}
+
+	messages := buf.messages
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+
+	texts := make([]string, len(messages))
+	urls := make([]string, len(messages))
+	var wg sync.WaitGroup
+	for i, message := range messages {
+		file, kind, ok := mediaFile(message)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, message Message, file Attachment, kind string) {
+			defer wg.Done()
+			texts[i], urls[i] = relayMedia(context.Background(), message, file, kind)
+		}(i, message, file, kind)
+	}
+	wg.Wait()
+
+	var caption string
+	for i, message := range messages {
+		telegramLog(message, urls[i])
+		if len(caption) == 0 {
+			caption = telegramCaption(message)
+		}
+	}
+
+	var parts []string
+	for _, text := range texts {
+		if len(text) > 0 {
+			parts = append(parts, text)
+		}
+	}
+	if len(caption) > 0 {
+		parts = append(parts, caption)
+	}
+
+	first := messages[0]
+	relay(first, telegramUsername(first), ircPrefix(first)+strings.Join(parts, " "))
+
+	// Map the rest of the album to the same IRC message so that replies to any part of it work
+	if relayed, ok := MappingByTelegram(first.Chat.ID, first.ID); ok {
+		for _, message := range messages[1:] {
+			mapping := *relayed
+			mapping.TelegramID = message.ID
+			mapping.Created = 0
+			// Echoes of the lines belong to the first message
+			mapping.LineHashes = nil
+			StoreMapping(&mapping)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attachment kinds. These are also the keys of the media-limits config option.
+const (
+	KindPhoto     = "photo"
+	KindSticker   = "sticker"
+	KindGIF       = "gif"
+	KindAudio     = "audio"
+	KindVoice     = "voice"
+	KindVideo     = "video"
+	KindVideoNote = "video_note"
+	KindDocument  = "document"
+)
+
+// defaultMediaLimit is the largest file bots can download from Telegram
+const defaultMediaLimit = 20 * 1024 * 1024
+
+// mediaFile returns the file in the message and its kind
+func mediaFile(message Message) (Attachment, string, bool) {
+	if len(message.Photo) > 0 {
+		photo := message.Photo[len(message.Photo)-1]
+		return Attachment{FileInfo: photo.FileInfo}, KindPhoto, true
+	} else if message.Sticker.Exists() {
+		return stickerFile(message.Sticker), KindSticker, true
+	} else if message.Document.Exists() && message.Document.Mime == "image/gif" {
+		return message.Document, KindGIF, true
+	} else if message.Voice.Exists() {
+		return message.Voice, KindVoice, true
+	} else if message.VideoNote.Exists() {
+		return message.VideoNote, KindVideoNote, true
+	} else if message.Audio.Exists() {
+		return message.Audio, KindAudio, true
+	} else if message.Video.Exists() {
+		return message.Video, KindVideo, true
+	} else if message.Document.Exists() {
+		return message.Document, KindDocument, true
+	}
+	return Attachment{}, "", false
+}
+
+// stickerFile returns the image that should be relayed for the given sticker. Animated (TGS)
+// and video (WebM) stickers can't be shown as images, so their static thumbnail is used
+// instead. If an animated sticker has no thumbnail, the file will be empty.
+func stickerFile(sticker Sticker) Attachment {
+	file := Attachment{FileInfo: sticker.FileInfo, Emoji: sticker.Emoji, SetName: sticker.SetName}
+	if sticker.IsAnimated || sticker.IsVideo {
+		preview, _ := sticker.Preview()
+		file.FileInfo = preview.FileInfo
+	}
+	return file
+}
+
+// isImage checks if files of the given kind are images that don't need a description on IRC
+func isImage(kind string) bool {
+	return kind == KindPhoto || kind == KindSticker || kind == KindGIF
+}
+
+// mediaLimit returns the maximum size of relayed files of the given kind in bytes
+func mediaLimit(kind string) int {
+	if limit, ok := config.MediaLimits[kind]; ok {
+		return limit * 1024
+	}
+	return defaultMediaLimit
+}
+
+// relayMedia uploads the given file and returns the text to send to IRC and the URL of the
+// uploaded file. If the file can't be uploaded, the text is a placeholder describing the file.
+func relayMedia(ctx context.Context, message Message, file Attachment, kind string) (string, string) {
+	desc := describeAttachment(file, kind)
+	if !file.Exists() {
+		return desc, ""
+	} else if file.FileSize > mediaLimit(kind) {
+		return desc + " (too large to relay)", ""
+	}
+
+	url, err := uploadFile(ctx, message, file, mediaLimit(kind))
+	if err == errNoMediaStore {
+		return desc, ""
+	} else if err != nil {
+		logf("[DEBUG] Failed to upload %s: %s\n", kind, err)
+		return desc + " (upload failed)", ""
+	} else if isImage(kind) {
+		return url, url
+	}
+	return fmt.Sprintf("%s %s", desc, url), url
+}
+
+// describeAttachment returns a short description of the attachment, e.g. "[voice (0:12, 34 KB)]"
+func describeAttachment(file Attachment, kind string) string {
+	desc := strings.Replace(kind, "_", " ", -1)
+	if kind == KindSticker {
+		if len(file.Emoji) > 0 {
+			desc = fmt.Sprintf("%s %s", desc, file.Emoji)
+		}
+		if len(file.SetName) > 0 {
+			desc = fmt.Sprintf("%s from %s", desc, file.SetName)
+		}
+		return "[" + desc + "]"
+	} else if kind == KindAudio && len(file.Title) > 0 {
+		if len(file.Performer) > 0 {
+			desc = fmt.Sprintf("%s %s - %s", desc, file.Performer, file.Title)
+		} else {
+			desc = fmt.Sprintf("%s %s", desc, file.Title)
+		}
+	} else if len(file.FileName) > 0 {
+		desc = fmt.Sprintf("%s %s", desc, file.FileName)
+	}
+
+	var details []string
+	if file.Duration > 0 {
+		details = append(details, fmt.Sprintf("%d:%02d", file.Duration/60, file.Duration%60))
+	}
+	if file.FileSize > 0 {
+		details = append(details, formatSize(file.FileSize))
+	}
+	if len(details) > 0 {
+		desc = fmt.Sprintf("%s (%s)", desc, strings.Join(details, ", "))
+	}
+	return "[" + desc + "]"
+}
+
+// formatSize formats a file size in bytes to a human-readable string
+func formatSize(size int) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	} else if size < 1024*1024 {
+		return fmt.Sprintf("%d KB", size/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+}
+
+func mediaTimeout() time.Duration {
+	if config.MediaTimeout > 0 {
+		return time.Duration(config.MediaTimeout) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// asyncMedia checks if the file should be uploaded in the background after sending a placeholder to IRC
+func asyncMedia(message Message, file Attachment, kind string) bool {
+	channel, ok := config.GetIRCChannel(strconv.FormatInt(message.Chat.ID, 10))
+	if !ok || !config.GetOptions(channel).AsyncMedia {
+		return false
+	}
+	_, _, ok = GetMediaStore(channel)
+	return ok && file.Exists() && file.FileSize <= mediaLimit(kind)
+}
+
+// relayMediaAsync sends a placeholder for the file to IRC immediately and follows up with
+// the link once the upload finishes. If it takes too long, the upload is cancelled and a
+// failure notice is sent instead.
+func relayMediaAsync(message Message, file Attachment, kind string) {
+	label := strings.Replace(kind, "_", " ", -1)
+	user := telegramUsername(message)
+
+	placeholder := fmt.Sprintf("[%s uploading…]", label)
+	if caption := telegramCaption(message); len(caption) > 0 {
+		placeholder = fmt.Sprintf("%s %s", placeholder, caption)
+	}
+	relay(message, user, ircPrefix(message)+placeholder)
+
+	ctx, cancel := context.WithTimeout(context.Background(), mediaTimeout())
+	defer cancel()
+	text, url := relayMedia(ctx, message, file, kind)
+	if len(url) == 0 && ctx.Err() == context.DeadlineExceeded {
+		logf("[DEBUG] Upload of %s in message %d timed out\n", kind, message.ID)
+		text = fmt.Sprintf("[%s upload timed out]", label)
+	}
+	telegramLog(message, url)
+	relay(message, user, text)
+}
@@ -0,0 +1,523 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIMethod is the URL format for calling Telegram Bot API methods
+const APIMethod = "https://api.telegram.org/bot%s/%s"
+
+// hideToken removes the bot token from the URL in HTTP client errors.
+// The token is a part of all Bot API URLs and the errors end up in the logs.
+func hideToken(err error) error {
+	if urlErr, ok := err.(*url.Error); ok && len(config.Telegram.Token) > 0 {
+		hidden := *urlErr
+		hidden.URL = strings.Replace(urlErr.URL, config.Telegram.Token, "<token>", -1)
+		return &hidden
+	}
+	return err
+}
+
+// APIResponse ...
+type APIResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+// User ...
+type User struct {
+	ID        int    `json:"id"`
+	IsBot     bool   `json:"is_bot,omitempty"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+// Chat ...
+type Chat struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// Message ...
+type Message struct {
+	ID       int    `json:"message_id"`
+	Sender   User   `json:"from"`
+	Unixtime int    `json:"date"`
+	Chat     Chat   `json:"chat"`
+	Text     string `json:"text"`
+
+	ReplyTo  *Message        `json:"reply_to_message"`
+	Entities []MessageEntity `json:"entities"`
+
+	OriginalSender   User `json:"forward_from"`
+	OriginalChat     Chat `json:"forward_from_chat"`
+	OriginalUnixtime int  `json:"forward_date"`
+
+	Caption         string          `json:"caption"`
+	CaptionEntities []MessageEntity `json:"caption_entities"`
+	MediaGroupID    string          `json:"media_group_id"`
+
+	Audio     Attachment  `json:"audio"`
+	Video     Attachment  `json:"video"`
+	Voice     Attachment  `json:"voice"`
+	VideoNote Attachment  `json:"video_note"`
+	Document  Attachment  `json:"document"`
+	Sticker   Sticker     `json:"sticker"`
+	Photo     []PhotoSize `json:"photo"`
+	Location  Location    `json:"location"`
+	Venue     Venue       `json:"venue"`
+	Contact   Contact     `json:"contact"`
+	Poll      Poll        `json:"poll"`
+
+	UserJoined       User        `json:"new_chat_member"`
+	UserLeft         User        `json:"left_chat_member"`
+	NewChatMembers   []User      `json:"new_chat_members"`
+	NewChatTitle     string      `json:"new_chat_title"`
+	NewChatPhoto     []PhotoSize `json:"new_chat_photo"`
+	ChatPhotoDeleted bool        `json:"delete_chat_photo"`
+	PinnedMessage    *Message    `json:"pinned_message"`
+	MigrateTo        int64       `json:"migrate_to_chat_id"`
+	MigrateFrom      int64       `json:"migrate_from_chat_id"`
+
+	ForwardOrigin     *MessageOrigin `json:"forward_origin"`
+	ForwardSignature  string         `json:"forward_signature"`
+	ForwardSenderName string         `json:"forward_sender_name"`
+
+	// IsEdit is set for messages received as edited_message updates
+	IsEdit bool `json:"-"`
+}
+
+// Time returns the time the message was sent
+func (message Message) Time() time.Time {
+	return time.Unix(int64(message.Unixtime), 0)
+}
+
+// Location ...
+type Location struct {
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	LivePeriod int     `json:"live_period"`
+}
+
+// Exists checks if the location is present in the message
+func (loc Location) Exists() bool {
+	return loc.Latitude != 0 || loc.Longitude != 0
+}
+
+// Contact ...
+type Contact struct {
+	PhoneNumber string `json:"phone_number"`
+	FirstName   string `json:"first_name"`
+	LastName    string `json:"last_name"`
+	UserID      int    `json:"user_id"`
+	VCard       string `json:"vcard"`
+}
+
+// Exists checks if the contact is present in the message
+func (contact Contact) Exists() bool {
+	return len(contact.PhoneNumber) > 0 || len(contact.FirstName) > 0
+}
+
+// Poll ...
+type Poll struct {
+	ID                    string       `json:"id"`
+	Question              string       `json:"question"`
+	Options               []PollOption `json:"options"`
+	TotalVoterCount       int          `json:"total_voter_count"`
+	IsClosed              bool         `json:"is_closed"`
+	Type                  string       `json:"type"`
+	AllowsMultipleAnswers bool         `json:"allows_multiple_answers"`
+	CorrectOptionID       *int         `json:"correct_option_id"`
+	OpenPeriod            int          `json:"open_period"`
+	CloseDate             int64        `json:"close_date"`
+}
+
+// Exists checks if the poll is present in the message
+func (poll Poll) Exists() bool {
+	return len(poll.ID) > 0
+}
+
+// PollOption ...
+type PollOption struct {
+	Text       string `json:"text"`
+	VoterCount int    `json:"voter_count"`
+}
+
+// Venue ...
+type Venue struct {
+	Location Location `json:"location"`
+	Title    string   `json:"title"`
+	Address  string   `json:"address"`
+}
+
+// FileInfo ...
+type FileInfo struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileSize     int    `json:"file_size"`
+}
+
+// Exists checks if the file is present in the message
+func (file FileInfo) Exists() bool {
+	return len(file.FileID) > 0
+}
+
+// Attachment is an audio, video, voice, video note or document file
+type Attachment struct {
+	FileInfo
+	Duration  int    `json:"duration"`
+	FileName  string `json:"file_name"`
+	Mime      string `json:"mime_type"`
+	Title     string `json:"title"`
+	Performer string `json:"performer"`
+
+	// Stickers are converted to attachments for relaying, so they need somewhere to keep these
+	Emoji   string `json:"emoji,omitempty"`
+	SetName string `json:"set_name,omitempty"`
+}
+
+// PhotoSize ...
+type PhotoSize struct {
+	FileInfo
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Sticker ...
+type Sticker struct {
+	FileInfo
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Emoji      string `json:"emoji"`
+	SetName    string `json:"set_name"`
+	IsAnimated bool   `json:"is_animated"`
+	IsVideo    bool   `json:"is_video"`
+
+	// Older Bot API versions call the thumbnail thumb
+	Thumbnail *PhotoSize `json:"thumbnail"`
+	Thumb     *PhotoSize `json:"thumb"`
+}
+
+// Preview returns the static thumbnail of the sticker, if it has one
+func (sticker Sticker) Preview() (PhotoSize, bool) {
+	if sticker.Thumbnail != nil {
+		return *sticker.Thumbnail, true
+	} else if sticker.Thumb != nil {
+		return *sticker.Thumb, true
+	}
+	return PhotoSize{}, false
+}
+
+// MessageEntity ...
+type MessageEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+	User   *User  `json:"user,omitempty"`
+}
+
+// Update ...
+type Update struct {
+	ID            int      `json:"update_id"`
+	Message       *Message `json:"message"`
+	EditedMessage *Message `json:"edited_message"`
+	Poll          *Poll    `json:"poll"`
+}
+
+// GetUpdatesParams ...
+type GetUpdatesParams struct {
+	Offset  int `json:"offset"`
+	Timeout int `json:"timeout"`
+}
+
+// SentMessage ...
+type SentMessage struct {
+	ID int `json:"message_id"`
+}
+
+// SendMessageParams ...
+type SendMessageParams struct {
+	ChatID              string `json:"chat_id"`
+	Text                string `json:"text"`
+	ParseMode           string `json:"parse_mode,omitempty"`
+	ReplyTo             int    `json:"reply_to_message_id,omitempty"`
+	AllowWithoutReply   bool   `json:"allow_sending_without_reply,omitempty"`
+	DisableNotification bool   `json:"disable_notification,omitempty"`
+}
+
+// DeleteMessageParams ...
+type DeleteMessageParams struct {
+	ChatID    int64 `json:"chat_id"`
+	MessageID int   `json:"message_id"`
+}
+
+// GetChatMemberParams ...
+type GetChatMemberParams struct {
+	ChatID int64 `json:"chat_id"`
+	UserID int   `json:"user_id"`
+}
+
+// SetChatDescriptionParams ...
+type SetChatDescriptionParams struct {
+	ChatID      int64  `json:"chat_id"`
+	Description string `json:"description"`
+}
+
+// SendPollParams ...
+type SendPollParams struct {
+	ChatID                string            `json:"chat_id"`
+	Question              string            `json:"question"`
+	Options               []InputPollOption `json:"options"`
+	Type                  string            `json:"type,omitempty"`
+	AllowsMultipleAnswers bool              `json:"allows_multiple_answers,omitempty"`
+	CorrectOptionID       *int              `json:"correct_option_id,omitempty"`
+	CloseDate             int64             `json:"close_date,omitempty"`
+	ReplyTo               int               `json:"reply_to_message_id,omitempty"`
+	AllowWithoutReply     bool              `json:"allow_sending_without_reply,omitempty"`
+}
+
+// InputPollOption ...
+type InputPollOption struct {
+	Text string `json:"text"`
+}
+
+// StopPollParams ...
+type StopPollParams struct {
+	ChatID    int64 `json:"chat_id"`
+	MessageID int   `json:"message_id"`
+}
+
+// ChatMember ...
+type ChatMember struct {
+	Status string `json:"status"`
+}
+
+// CallAPI calls the given Telegram Bot API method and decodes the result into result
+func CallAPI(method string, params, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Post(fmt.Sprintf(APIMethod, config.Telegram.Token, method), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return hideToken(err)
+	}
+	defer resp.Body.Close()
+	return decodeAPIResponse(method, resp, result)
+}
+
+// UploadFile is a file sent to the Telegram API in a multipart request
+type UploadFile struct {
+	Field string
+	Name  string
+	Data  io.Reader
+}
+
+// CallAPIMultipart calls the given Telegram Bot API method with the given form fields and file.
+// The file is streamed to the API instead of being read into memory.
+func CallAPIMultipart(method string, fields map[string]string, file UploadFile, result interface{}) error {
+	body, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	go func() {
+		for key, val := range fields {
+			if err := writer.WriteField(key, val); err != nil {
+				pipe.CloseWithError(err)
+				return
+			}
+		}
+		part, err := writer.CreateFormFile(file.Field, file.Name)
+		if err == nil {
+			_, err = io.Copy(part, file.Data)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pipe.CloseWithError(err)
+	}()
+
+	resp, err := http.DefaultClient.Post(fmt.Sprintf(APIMethod, config.Telegram.Token, method), writer.FormDataContentType(), body)
+	if err != nil {
+		body.CloseWithError(err)
+		return hideToken(err)
+	}
+	defer resp.Body.Close()
+	return decodeAPIResponse(method, resp, result)
+}
+
+func decodeAPIResponse(method string, resp *http.Response, result interface{}) error {
+	var r = APIResponse{}
+	dec := json.NewDecoder(resp.Body)
+	err := dec.Decode(&r)
+	if err != nil {
+		return err
+	} else if !r.OK {
+		return fmt.Errorf("%s failed: %s", method, r.Description)
+	}
+
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+// SendTelegramMessage sends a Markdown message to the given chat and returns the ID of the sent message.
+// If replyTo is not zero, the message is sent as a reply to that message.
+func SendTelegramMessage(chat, text string, replyTo int) (int, error) {
+	var sent = SentMessage{}
+	err := CallAPI("sendMessage", &SendMessageParams{
+		ChatID:            chat,
+		Text:              text,
+		ParseMode:         "Markdown",
+		ReplyTo:           replyTo,
+		AllowWithoutReply: true,
+	}, &sent)
+	return sent.ID, err
+}
+
+// GetMe returns the user of the bot
+func GetMe() (User, error) {
+	var user = User{}
+	err := CallAPI("getMe", struct{}{}, &user)
+	return user, err
+}
+
+// DeleteTelegramMessage deletes the given message from the given chat
+func DeleteTelegramMessage(chat int64, id int) error {
+	return CallAPI("deleteMessage", &DeleteMessageParams{ChatID: chat, MessageID: id}, nil)
+}
+
+// IsTelegramAdmin checks if the given user is an administrator of the given chat
+func IsTelegramAdmin(chat int64, user int) (bool, error) {
+	var member = ChatMember{}
+	err := CallAPI("getChatMember", &GetChatMemberParams{ChatID: chat, UserID: user}, &member)
+	return member.Status == "creator" || member.Status == "administrator", err
+}
+
+// SendTelegramPoll sends a copy of the given poll to the given chat and returns the sent message
+func SendTelegramPoll(chat string, poll Poll, replyTo int) (Message, error) {
+	params := &SendPollParams{
+		ChatID:                chat,
+		Question:              poll.Question,
+		Options:               make([]InputPollOption, len(poll.Options)),
+		AllowsMultipleAnswers: poll.AllowsMultipleAnswers,
+		ReplyTo:               replyTo,
+		AllowWithoutReply:     true,
+	}
+	for i, option := range poll.Options {
+		params.Options[i].Text = option.Text
+	}
+	// The correct answer of a quiz is only known if the quiz was sent by a bot
+	if poll.Type == "quiz" && poll.CorrectOptionID != nil {
+		params.Type = "quiz"
+		params.CorrectOptionID = poll.CorrectOptionID
+	}
+	// Telegram only accepts close dates between 5 and 600 seconds in the future
+	if until := poll.CloseDate - time.Now().Unix(); until >= 5 && until <= 600 {
+		params.CloseDate = poll.CloseDate
+	}
+
+	var sent = Message{}
+	err := CallAPI("sendPoll", params, &sent)
+	return sent, err
+}
+
+// StopTelegramPoll closes a poll sent by the bot and returns the final state of the poll
+func StopTelegramPoll(chat int64, id int) (Poll, error) {
+	var poll = Poll{}
+	err := CallAPI("stopPoll", &StopPollParams{ChatID: chat, MessageID: id}, &poll)
+	return poll, err
+}
+
+// SetTelegramDescription changes the description of the given chat
+func SetTelegramDescription(chat int64, description string) error {
+	return CallAPI("setChatDescription", &SetChatDescriptionParams{ChatID: chat, Description: description}, nil)
+}
+
+// SendTelegramPhoto uploads an image with a Markdown caption to the given chat and returns the ID of the sent message.
+// Animated images are sent as animations, as photos are always static.
+func SendTelegramPhoto(chat, caption string, replyTo int, name string, data io.Reader, animated bool) (int, error) {
+	if animated {
+		return sendTelegramFile("sendAnimation", "animation", chat, caption, replyTo, name, data)
+	}
+	return sendTelegramFile("sendPhoto", "photo", chat, caption, replyTo, name, data)
+}
+
+// SendTelegramDocument uploads a file with a Markdown caption to the given chat and returns the ID of the sent message
+func SendTelegramDocument(chat, caption string, replyTo int, name string, data io.Reader) (int, error) {
+	return sendTelegramFile("sendDocument", "document", chat, caption, replyTo, name, data)
+}
+
+func sendTelegramFile(method, field, chat, caption string, replyTo int, name string, data io.Reader) (int, error) {
+	fields := map[string]string{
+		"chat_id":    chat,
+		"caption":    caption,
+		"parse_mode": "Markdown",
+	}
+	if replyTo != 0 {
+		fields["reply_to_message_id"] = strconv.Itoa(replyTo)
+		fields["allow_sending_without_reply"] = "true"
+	}
+
+	var sent = SentMessage{}
+	err := CallAPIMultipart(method, fields, UploadFile{Field: field, Name: name, Data: data}, &sent)
+	return sent.ID, err
+}
+
+// listen long-polls the Telegram API for updates and passes new messages to the given channel
+func listen(messages chan<- Message) {
+	var offset int
+	for {
+		var updates []Update
+		err := CallAPI("getUpdates", &GetUpdatesParams{Offset: offset, Timeout: 30}, &updates)
+		if err != nil {
+			logf("[DEBUG] Failed to get updates from Telegram: %s\n", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, update := range updates {
+			offset = update.ID + 1
+			if update.Message != nil {
+				messages <- *update.Message
+			} else if update.EditedMessage != nil {
+				edit := *update.EditedMessage
+				edit.IsEdit = true
+				messages <- edit
+			} else if update.Poll != nil {
+				go pollUpdate(*update.Poll)
+			}
+		}
+	}
+}
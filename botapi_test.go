@@ -0,0 +1,47 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHideToken(t *testing.T) {
+	config = &Config{}
+	config.Telegram.Token = "123456:secret"
+	defer func() { config = nil }()
+
+	// Nothing listens on port 1, so the request fails with the URL in the error
+	_, err := get(context.Background(), "http://127.0.0.1:1/file/bot123456:secret/photo.jpg")
+	if err == nil {
+		t.Fatal("expected request to fail")
+	} else if strings.Contains(err.Error(), "secret") {
+		t.Errorf("token in error: %s", err)
+	} else if !strings.Contains(err.Error(), "/file/bot<token>/photo.jpg") {
+		t.Errorf("URL missing from error: %s", err)
+	}
+
+	_, err = get(context.Background(), "http://127.0.0.1:1/bot123456:secret/\x7f")
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("token in invalid URL error: %v", err)
+	}
+
+	if err = hideToken(nil); err != nil {
+		t.Errorf("nil error became %v", err)
+	}
+}
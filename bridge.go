@@ -25,6 +25,8 @@ const version = "Telegram-IRC Bridge 1.0"
 
 func main() {
 	LoadConfig()
+	openStore()
+	initMediaStores()
 	go startTelegram()
 	go startIRC()
 
@@ -36,6 +38,7 @@ func main() {
 
 func shutdown() {
 	stopIRC()
+	closeStore()
 	stopLogger()
 	os.Exit(0)
 }
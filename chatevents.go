@@ -0,0 +1,188 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// maxDescription is the maximum length of Telegram group descriptions
+const maxDescription = 255
+
+// isChatEvent checks if the message is a pin or a change of the group title or photo
+func isChatEvent(message Message) bool {
+	return message.PinnedMessage != nil || len(message.NewChatTitle) > 0 ||
+		len(message.NewChatPhoto) > 0 || message.ChatPhotoDeleted
+}
+
+// telegramChatEvent logs and relays pins and group title and photo changes
+func telegramChatEvent(message Message) {
+	var logType, data, text string
+	if message.PinnedMessage != nil {
+		pin := message
+		pin.ReplyTo = message.PinnedMessage
+		excerpt := replyExcerpt(pin)
+		logType, data = "PIN", strconv.Itoa(message.PinnedMessage.ID)
+		text = fmt.Sprintf("* pinned a message by %s", ircReplyName(pin))
+		if len(excerpt) > 0 {
+			text += ": " + excerpt
+		}
+	} else if len(message.NewChatTitle) > 0 {
+		logType, data = "TITLE", message.NewChatTitle
+		text = "* changed the group title to " + message.NewChatTitle
+	} else if len(message.NewChatPhoto) > 0 {
+		photo := message.NewChatPhoto[len(message.NewChatPhoto)-1]
+		url, err := uploadFile(context.Background(), message, Attachment{FileInfo: photo.FileInfo}, mediaLimit(KindPhoto))
+		if err != nil && err != errNoMediaStore {
+			logf("[DEBUG] Failed to upload new group photo: %s\n", err)
+		}
+		logType, data = "PHOTO", url
+		text = "* changed the group photo"
+		if len(url) > 0 {
+			text += ": " + url
+		}
+	} else {
+		logType = "PHOTO"
+		text = "* removed the group photo"
+	}
+
+	// Type>ID|Timestamp|Username|UID|Data
+	logf("%[6]s>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s\n",
+		message.ID,
+		message.Time().Unix(),
+		telegramUsername(message),
+		message.Sender.ID,
+		data,
+		logType,
+	)
+
+	channel, ok := ircmessage(message.Chat.ID, telegramUsername(message), text)
+	if ok && len(message.NewChatTitle) > 0 && config.GetOptions(channel).TitleToTopic {
+		irc.SendRawf("TOPIC %s :%s", channel, message.NewChatTitle)
+	}
+}
+
+// ircTopic logs a topic change on IRC and copies the topic to the Telegram group description if enabled
+func ircTopic(channel, nick, topic string) {
+	tgChan, ok := config.GetTelegramChannel(channel)
+	if !ok {
+		return
+	}
+
+	logf("IRCTOPIC>%[1]d|%[2]s|%[3]s\n", time.Now().Unix(), nick, topic)
+	if !config.GetOptions(channel).TopicToDescription {
+		return
+	}
+
+	if runes := []rune(topic); len(runes) > maxDescription {
+		topic = string(runes[:maxDescription])
+	}
+	chat, _ := strconv.ParseInt(tgChan.Sender, 10, 64)
+	if err := SetTelegramDescription(chat, topic); err != nil {
+		logf("[DEBUG] Failed to set description of %d: %s\n", chat, err)
+	}
+}
+
+// telegramMigrate updates the mapping of a group that was upgraded to a supergroup.
+// Telegram sends a service message to both the old and the new chat, so this may be called twice.
+func telegramMigrate(message Message) {
+	from, to := message.Chat.ID, message.MigrateTo
+	if message.MigrateFrom != 0 {
+		from, to = message.MigrateFrom, message.Chat.ID
+	}
+
+	channel, ok := config.MigrateTelegramChannel(strconv.FormatInt(from, 10), strconv.FormatInt(to, 10))
+	if !ok {
+		return
+	}
+
+	// Type>ID|Timestamp|OldChat|NewChat|IRCChannel
+	logf("MIGRATE>%[1]d|%[2]d|%[3]d|%[4]d|%[5]s\n",
+		message.ID,
+		message.Time().Unix(),
+		from,
+		to,
+		channel,
+	)
+	if err := MigrateChat(from, to); err != nil {
+		logf("[DEBUG] Failed to migrate stored data of %d to %d: %s\n", from, to, err)
+	}
+	if err := SaveMapping(channel); err != nil {
+		logf("[DEBUG] Failed to save migrated mapping of %s: %s\n", channel, err)
+	}
+}
+
+// isMembershipEvent checks if the message is about users joining or leaving the group
+func isMembershipEvent(message Message) bool {
+	return len(message.NewChatMembers) > 0 || message.UserJoined.ID != 0 || message.UserLeft.ID != 0
+}
+
+// telegramMembership logs and relays users joining or leaving the group.
+// Users added or removed by someone else are attributed to the user who added or removed them.
+func telegramMembership(message Message) {
+	channel, _ := config.GetIRCChannel(strconv.FormatInt(message.Chat.ID, 10))
+	by := formatNick(channel, telegramUsername(message))
+
+	joined := message.NewChatMembers
+	if len(joined) == 0 && message.UserJoined.ID != 0 {
+		joined = []User{message.UserJoined}
+	}
+	for _, user := range joined {
+		StoreTelegramUser(message.Chat.ID, user)
+		text := "* joined the group"
+		if user.ID != message.Sender.ID {
+			text = "* was added to the group by " + by
+		}
+		logMembership("JOIN", message, user)
+		ircmessage(message.Chat.ID, telegramName(user), text)
+	}
+
+	if user := message.UserLeft; user.ID != 0 {
+		text := "* left the group"
+		if user.ID != message.Sender.ID {
+			text = "* was removed from the group by " + by
+		}
+		logMembership("LEAVE", message, user)
+		ircmessage(message.Chat.ID, telegramName(user), text)
+	}
+}
+
+func logMembership(logType string, message Message, user User) {
+	if user.ID == message.Sender.ID {
+		// Type>ID|Timestamp|Username|UID
+		logf("%[5]s>%[1]d|%[2]d|%[3]s|%[4]d\n",
+			message.ID,
+			message.Time().Unix(),
+			telegramName(user),
+			user.ID,
+			logType,
+		)
+		return
+	}
+	// Type>ID|Timestamp|Username|UID||ByUsername|ByUID
+	logf("%[7]s>%[1]d|%[2]d|%[3]s|%[4]d§%[5]s|%[6]d\n",
+		message.ID,
+		message.Time().Unix(),
+		telegramName(user),
+		user.ID,
+		telegramUsername(message),
+		message.Sender.ID,
+		logType,
+	)
+}
@@ -16,21 +16,52 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
 )
 
 // Config ...
 type Config struct {
-	Mappings map[string]string `json:"mappings"`
+	Mappings       map[string]string         `json:"mappings"`
+	MappingOptions map[string]MappingOptions `json:"mapping-options"`
 
 	Telegram Telegram `json:"telegram"`
 	IRC      IRC      `json:"irc"`
 	MIS      MIS      `json:"mis"`
+	Store    Store    `json:"store"`
+
+	// The media store used for mappings that don't specify one: "mis", "local" or "s3"
+	MediaStore string `json:"media-store"`
+	Local      Local  `json:"local"`
+	S3         S3     `json:"s3"`
+	HTTP       HTTP   `json:"http"`
+
+	// Maximum sizes of relayed files in kilobytes by type, e.g. "video" or "voice"
+	MediaLimits map[string]int `json:"media-limits"`
+	// Seconds to wait for asynchronous uploads before sending a failure notice
+	MediaTimeout int `json:"media-timeout"`
+	// Maximum size of images linked on IRC to send to Telegram in kilobytes
+	IRCImageLimit int    `json:"irc-image-limit"`
+	Images        Images `json:"images"`
+	DCC           DCC    `json:"dcc"`
+
+	// Map link format: "google", "openstreetmap", "geo" or a template with {lat} and {lon} placeholders
+	MapURL string `json:"map-url"`
+	// Minimum number of seconds between relayed live location updates of a single message
+	LiveLocationInterval int `json:"live-location-interval"`
 }
 
+// mappingsLock protects Mappings, which change when a Telegram group is migrated to a supergroup
+var mappingsLock sync.RWMutex
+
 // GetTelegramChannel ...
 func (config *Config) GetTelegramChannel(ircChannel string) (SimpleUser, bool) {
+	mappingsLock.RLock()
+	defer mappingsLock.RUnlock()
 	for key, val := range config.Mappings {
 		if key == ircChannel {
 			return SimpleUser{val}, true
@@ -41,6 +72,8 @@ func (config *Config) GetTelegramChannel(ircChannel string) (SimpleUser, bool) {
 
 // GetIRCChannel ...
 func (config *Config) GetIRCChannel(telegramChannel string) (string, bool) {
+	mappingsLock.RLock()
+	defer mappingsLock.RUnlock()
 	for key, val := range config.Mappings {
 		if val == telegramChannel {
 			return key, true
@@ -49,9 +82,62 @@ func (config *Config) GetIRCChannel(telegramChannel string) (string, bool) {
 	return "", false
 }
 
+// IRCChannels returns the bridged IRC channels
+func (config *Config) IRCChannels() []string {
+	mappingsLock.RLock()
+	defer mappingsLock.RUnlock()
+	channels := make([]string, 0, len(config.Mappings))
+	for key := range config.Mappings {
+		channels = append(channels, key)
+	}
+	return channels
+}
+
+// MigrateTelegramChannel changes the Telegram group bridged to an IRC channel from the old chat ID to the new one.
+// The IRC channel is returned if a mapping was changed.
+func (config *Config) MigrateTelegramChannel(oldChannel, newChannel string) (string, bool) {
+	mappingsLock.Lock()
+	defer mappingsLock.Unlock()
+	for key, val := range config.Mappings {
+		if val == oldChannel {
+			config.Mappings[key] = newChannel
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// GetOptions returns the options for the given IRC channel
+func (config *Config) GetOptions(ircChannel string) MappingOptions {
+	return config.MappingOptions[ircChannel]
+}
+
+// MappingOptions contains options for a single IRC channel <-> Telegram group mapping
+type MappingOptions struct {
+	// How relayed names are kept from highlighting IRC users: "", "zwsp" or "substitute"
+	NickProtection string `json:"nick-protection"`
+	NickColors     bool   `json:"nick-colors"`
+	MediaStore     string `json:"media-store"`
+	// Send a placeholder to IRC immediately and follow up with the link when the upload finishes
+	AsyncMedia bool `json:"async-media"`
+	// Send images linked on IRC to Telegram as photos
+	IRCImages bool `json:"irc-images"`
+	// Leave phone numbers out of relayed contacts and their vCards
+	HidePhoneNumbers bool `json:"hide-phone-numbers"`
+	// Send a notice to IRC when a relayed Telegram message is deleted with the delete command.
+	// Other deletions can't be relayed, as the Bot API doesn't report them to bots.
+	NotifyDeletions bool `json:"notify-deletions"`
+	// Set the IRC topic when the Telegram group title changes. The bot must be allowed to change the topic.
+	TitleToTopic bool `json:"title-to-topic"`
+	// Set the Telegram group description when the IRC topic changes. The bot must be a group admin.
+	TopicToDescription bool `json:"topic-to-description"`
+}
+
 // Telegram ...
 type Telegram struct {
 	Token string `json:"token"`
+	// How long to wait for more messages of an album in milliseconds
+	AlbumWindow int `json:"album-window"`
 }
 
 // IRC ...
@@ -61,6 +147,9 @@ type IRC struct {
 	Nick     string `json:"nick"`
 	Password string `json:"password"`
 	TLS      bool   `json:"tls"`
+
+	// Maximum length of quoted replies. 0 means default (50) and negative disables quoting.
+	ReplyQuote int `json:"reply-quote"`
 }
 
 // MIS ...
@@ -70,6 +159,56 @@ type MIS struct {
 	Password string `json:"password"`
 }
 
+// Local ...
+type Local struct {
+	Directory string `json:"directory"`
+	// How files are named: "random" (default) or "hash"
+	Naming string `json:"naming"`
+	// Number of hours after which files are removed. 0 means never.
+	Expiry int `json:"expiry"`
+}
+
+// S3 ...
+type S3 struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access-key"`
+	SecretKey string `json:"secret-key"`
+	TLS       bool   `json:"tls"`
+	PublicURL string `json:"public-url"`
+	// Number of hours after which a lifecycle rule of the bucket removes objects. 0 means never.
+	Expiry int `json:"expiry"`
+}
+
+// HTTP ...
+type HTTP struct {
+	Address   string `json:"address"`
+	PublicURL string `json:"public-url"`
+}
+
+// Images ...
+type Images struct {
+	// Images larger than this in either dimension are downsized. 0 means no limit.
+	MaxDimension int `json:"max-dimension"`
+	JPEGQuality  int `json:"jpeg-quality"`
+}
+
+// DCC ...
+type DCC struct {
+	Enabled bool `json:"enabled"`
+	// Maximum size of received files in kilobytes
+	MaxSize int `json:"max-size"`
+	// Nicks or nick!user@host masks that may send files. Empty means everyone in a bridged channel.
+	Allowlist []string `json:"allowlist"`
+}
+
+// Store ...
+type Store struct {
+	Path   string `json:"path"`
+	MaxAge int    `json:"max-age"`
+}
+
 var config *Config
 
 // LoadConfig loads the config
@@ -84,3 +223,83 @@ func LoadConfig() {
 		panic(err)
 	}
 }
+
+// SaveMapping writes the Telegram group currently bridged to the given IRC channel to the config file.
+// Only the value of the mapping is replaced, so the rest of the file is kept exactly as it is.
+func SaveMapping(ircChannel string) error {
+	data, err := ioutil.ReadFile("config.json")
+	if err != nil {
+		return err
+	}
+	start, end, err := mappingValueRange(data, ircChannel)
+	if err != nil {
+		return err
+	}
+
+	mappingsLock.RLock()
+	value, err := json.Marshal(config.Mappings[ircChannel])
+	mappingsLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	var updated []byte
+	updated = append(updated, data[:start]...)
+	updated = append(updated, value...)
+	updated = append(updated, data[end:]...)
+	// Write to a temporary file first so that a failed write doesn't corrupt the config
+	err = ioutil.WriteFile("config.json.tmp", updated, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename("config.json.tmp", "config.json")
+}
+
+// mappingValueRange finds the byte range of the value of the given IRC channel in the mappings of the config file data
+func mappingValueRange(data []byte, ircChannel string) (start, end int, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return 0, 0, fmt.Errorf("config isn't a JSON object")
+	}
+	start = -1
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return 0, 0, err
+		} else if key != "mappings" {
+			var value json.RawMessage
+			if err = decoder.Decode(&value); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+
+		if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+			return 0, 0, fmt.Errorf("mappings isn't a JSON object")
+		}
+		for decoder.More() {
+			channel, err := decoder.Token()
+			if err != nil {
+				return 0, 0, err
+			}
+			afterKey := int(decoder.InputOffset())
+			value, err := decoder.Token()
+			if err != nil {
+				return 0, 0, err
+			} else if _, ok := value.(string); !ok {
+				return 0, 0, fmt.Errorf("mapping of %v isn't a string", channel)
+			} else if channel == ircChannel {
+				// The value starts after the colon and any whitespace following the key
+				start = afterKey + bytes.IndexByte(data[afterKey:], '"')
+				end = int(decoder.InputOffset())
+			}
+		}
+		if _, err = decoder.Token(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if start < 0 {
+		return 0, 0, fmt.Errorf("no mapping for %s in config", ircChannel)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,60 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import "testing"
+
+func TestMappingValueRange(t *testing.T) {
+	const config = `{
+    "telegram": {"token": "x", "mappings": {"#a": "1"}},
+    "mappings" : {
+        "#other": "-100",
+        "#chan":   "-123"
+    },
+    "irc": {}
+}`
+	tests := []struct {
+		name    string
+		data    string
+		channel string
+		value   string
+		err     bool
+	}{
+		{"mapping", config, "#chan", `"-123"`, false},
+		{"first mapping", config, "#other", `"-100"`, false},
+		{"nested mappings ignored", config, "#a", "", true},
+		{"missing mapping", config, "#missing", "", true},
+		{"compact", `{"mappings":{"#chan":"5"}}`, "#chan", `"5"`, false},
+		{"escaped key", `{"mappings":{"\u0023chan":"5"}}`, "#chan", `"5"`, false},
+		{"not an object", `[]`, "#chan", "", true},
+		{"mappings not an object", `{"mappings":[]}`, "#chan", "", true},
+		{"truncated", `{"mappings":{"#chan":"5"`, "#chan", "", true},
+	}
+	for _, test := range tests {
+		start, end, err := mappingValueRange([]byte(test.data), test.channel)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got range %d-%d", test.name, start, end)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if value := test.data[start:end]; value != test.value {
+			t.Errorf("%s: got %q, expected %q", test.name, value, test.value)
+		}
+	}
+}
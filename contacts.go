@@ -0,0 +1,132 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// contactName returns the full name of the contact
+func contactName(contact Contact) string {
+	return strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+}
+
+// contactText returns the IRC text for a contact message
+func contactText(message Message) string {
+	channel, _ := config.GetIRCChannel(strconv.FormatInt(message.Chat.ID, 10))
+	hidePhone := config.GetOptions(channel).HidePhoneNumbers
+	contact := message.Contact
+
+	text := "[contact] " + contactName(contact)
+	if !hidePhone && len(contact.PhoneNumber) > 0 {
+		text = fmt.Sprintf("%s (%s)", text, contact.PhoneNumber)
+	}
+	url, err := uploadVCard(channel, contactVCard(contact, hidePhone))
+	if err == nil {
+		return text + ": " + url
+	} else if err != errNoMediaStore {
+		logf("[DEBUG] Failed to upload vCard of contact in message %d: %s\n", message.ID, err)
+	}
+	return text
+}
+
+// uploadVCard uploads the given vCard to the media store of the IRC channel
+func uploadVCard(channel, card string) (string, error) {
+	storeName, store, ok := GetMediaStore(channel)
+	if !ok || !store.SupportsMime("text/vcard") {
+		return "", errNoMediaStore
+	}
+
+	file := strings.NewReader(card)
+	hash, err := fileHash(file)
+	if err != nil {
+		return "", err
+	} else if url, ok := CachedMediaURL(storeName, "hash:"+hash); ok {
+		return url, nil
+	}
+	url, err := store.Upload(context.Background(), file, file.Size(), "text/vcard")
+	if err == nil {
+		CacheMediaURL(storeName, url, "hash:"+hash)
+	}
+	return url, err
+}
+
+// contactVCard returns a vCard for the contact. The vCard sent by the user is used if there is one.
+// If hidePhone is set, phone numbers are removed from the vCard.
+func contactVCard(contact Contact, hidePhone bool) string {
+	if len(contact.VCard) > 0 {
+		lines := unfoldVCard(contact.VCard)
+		card := make([]string, 0, len(lines))
+		for _, line := range lines {
+			if hidePhone && isPhoneProperty(line) {
+				continue
+			}
+			card = append(card, line)
+		}
+		return strings.Join(card, "\r\n")
+	}
+
+	card := []string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"N:" + vcardEscape(contact.LastName) + ";" + vcardEscape(contact.FirstName) + ";;;",
+		"FN:" + vcardEscape(contactName(contact)),
+	}
+	if !hidePhone && len(contact.PhoneNumber) > 0 {
+		card = append(card, "TEL;TYPE=CELL:"+vcardEscape(contact.PhoneNumber))
+	}
+	if contact.UserID != 0 {
+		card = append(card, fmt.Sprintf("X-TELEGRAM-ID:%d", contact.UserID))
+	}
+	card = append(card, "END:VCARD", "")
+	return strings.Join(card, "\r\n")
+}
+
+// unfoldVCard splits a vCard into lines and joins folded lines, which continue the previous line
+// if they start with a space or a tab, so that every property is on a single line
+func unfoldVCard(card string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.Replace(card, "\r\n", "\n", -1), "\n") {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// isPhoneProperty checks if the given vCard line contains a phone number
+func isPhoneProperty(line string) bool {
+	name := strings.ToUpper(line)
+	if i := strings.IndexAny(name, ";:"); i >= 0 {
+		name = name[:i]
+	}
+	// Strip the group prefix, e.g. "item1.TEL"
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name == "TEL"
+}
+
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`)
+
+func vcardEscape(value string) string {
+	return vcardEscaper.Replace(value)
+}
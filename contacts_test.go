@@ -0,0 +1,46 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContactVCard(t *testing.T) {
+	tests := []struct {
+		name     string
+		vcard    string
+		hidden   bool
+		expected string
+	}{
+		{"kept", "BEGIN:VCARD\r\nTEL:+1555\r\nEND:VCARD", false, "BEGIN:VCARD\r\nTEL:+1555\r\nEND:VCARD"},
+		{"hidden", "BEGIN:VCARD\r\nTEL:+1555\r\nEND:VCARD", true, "BEGIN:VCARD\r\nEND:VCARD"},
+		{"folded with space", "BEGIN:VCARD\r\nTEL;TYPE=CELL:+1\r\n 555\r\n 1234\r\nFN:Bob\r\nEND:VCARD", true, "BEGIN:VCARD\r\nFN:Bob\r\nEND:VCARD"},
+		{"folded with tab", "BEGIN:VCARD\nitem1.TEL:+1\n\t5551234\nEND:VCARD", true, "BEGIN:VCARD\r\nEND:VCARD"},
+		{"folded property name", "BEGIN:VCARD\r\nT\r\n EL:+15551234\r\nEND:VCARD", true, "BEGIN:VCARD\r\nEND:VCARD"},
+		{"other folded property", "BEGIN:VCARD\r\nNOTE:long\r\n  note\r\nEND:VCARD", true, "BEGIN:VCARD\r\nNOTE:long note\r\nEND:VCARD"},
+	}
+	for _, test := range tests {
+		card := contactVCard(Contact{FirstName: "Bob", PhoneNumber: "+15551234", VCard: test.vcard}, test.hidden)
+		if card != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, card, test.expected)
+		}
+		if test.hidden && strings.Contains(card, "555") {
+			t.Errorf("%s: phone number in %q", test.name, card)
+		}
+	}
+}
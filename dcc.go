@@ -0,0 +1,279 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dccTimeout is how long a DCC transfer may stall before it's aborted
+const dccTimeout = 30 * time.Second
+
+// DCCOffer is a parsed DCC SEND request
+type DCCOffer struct {
+	FileName string
+	Address  string
+	Size     int64
+}
+
+// ParseDCCSend parses the text of a DCC SEND CTCP message, e.g. `DCC SEND "file name.txt" 3232235521 5000 1234`
+func ParseDCCSend(ctcp string) (DCCOffer, error) {
+	var offer DCCOffer
+	if !strings.HasPrefix(ctcp, "DCC SEND ") {
+		return offer, errors.New("not a DCC SEND")
+	}
+	rest := strings.TrimPrefix(ctcp, "DCC SEND ")
+
+	if strings.HasPrefix(rest, "\"") {
+		end := strings.Index(rest[1:], "\"")
+		if end < 0 {
+			return offer, errors.New("unterminated file name")
+		}
+		offer.FileName = rest[1 : end+1]
+		rest = rest[end+2:]
+	} else {
+		parts := strings.SplitN(rest, " ", 2)
+		if len(parts) < 2 {
+			return offer, errors.New("missing address")
+		}
+		offer.FileName, rest = parts[0], parts[1]
+	}
+	// Never trust paths from the other side
+	offer.FileName = filepath.Base(path.Base(offer.FileName))
+	if offer.FileName == "." || offer.FileName == "/" {
+		return offer, errors.New("missing file name")
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 2 {
+		return offer, errors.New("missing address or port")
+	}
+
+	var ip net.IP
+	if num, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+		ip = make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(num))
+	} else if ip = net.ParseIP(fields[0]); ip == nil {
+		return offer, fmt.Errorf("invalid address %s", fields[0])
+	}
+
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port < 0 || port > 65535 {
+		return offer, fmt.Errorf("invalid port %s", fields[1])
+	} else if port == 0 {
+		return offer, errors.New("passive DCC is not supported")
+	}
+	offer.Address = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	if len(fields) > 2 {
+		offer.Size, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || offer.Size < 0 {
+			return offer, fmt.Errorf("invalid size %s", fields[2])
+		}
+	}
+	return offer, nil
+}
+
+func dccLimit() int64 {
+	if config.DCC.MaxSize > 0 {
+		return int64(config.DCC.MaxSize) * 1024
+	}
+	return 10 * 1024 * 1024
+}
+
+// dccAllowed checks if the given user may send files to Telegram over DCC.
+// An empty allowlist allows everyone who is in a bridged channel.
+func dccAllowed(nick, user, host string) bool {
+	if len(config.DCC.Allowlist) == 0 {
+		return true
+	}
+	mask := strings.ToLower(fmt.Sprintf("%s!%s@%s", nick, user, host))
+	for _, pattern := range config.DCC.Allowlist {
+		pattern = strings.ToLower(pattern)
+		if pattern == strings.ToLower(nick) {
+			return true
+		} else if ok, _ := path.Match(pattern, mask); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dccFromHost checks if the address in the offer belongs to the host the offer came from, so that
+// the bridge can't be told to connect to other servers. Offers from cloaked hosts are rejected.
+func dccFromHost(offer DCCOffer, host string) bool {
+	offerHost, _, err := net.SplitHostPort(offer.Address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(offerHost)
+	if hostIP := net.ParseIP(host); hostIP != nil {
+		return hostIP.Equal(ip)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dccTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dccOffer handles a DCC SEND offer by receiving the file and posting it to the Telegram group
+// linked to the bridged channel the sender is in. Senders in several bridged channels are rejected,
+// as there's no way to tell which group the file is meant for.
+func dccOffer(nick, user, host, ctcp string) {
+	if !config.DCC.Enabled || !strings.HasPrefix(ctcp, "DCC SEND ") {
+		return
+	}
+
+	offer, err := ParseDCCSend(ctcp)
+	if err != nil {
+		irc.Noticef(nick, "Can't accept your file: %s", err)
+		return
+	}
+
+	channels := mappedChannelsOf(nick)
+	if len(channels) == 0 {
+		logf("[DEBUG] Rejected DCC SEND of %s from %s: not in a bridged channel\n", offer.FileName, nick)
+		return
+	} else if !dccAllowed(nick, user, host) {
+		logf("[DEBUG] Rejected DCC SEND of %s from %s: not allowed\n", offer.FileName, nick)
+		irc.Noticef(nick, "You're not allowed to send files to Telegram.")
+		return
+	} else if len(channels) > 1 {
+		logf("[DEBUG] Rejected DCC SEND of %s from %s: in several bridged channels\n", offer.FileName, nick)
+		irc.Noticef(nick, "You're in several bridged channels (%s), so I don't know where to send %s.", strings.Join(channels, ", "), offer.FileName)
+		return
+	} else if offer.Size > dccLimit() {
+		irc.Noticef(nick, "%s is too large to send to Telegram (max %s).", offer.FileName, formatSize(int(dccLimit())))
+		return
+	} else if !dccFromHost(offer, host) {
+		logf("[DEBUG] Rejected DCC SEND of %s from %s: %s doesn't belong to %s\n", offer.FileName, nick, offer.Address, host)
+		irc.Noticef(nick, "Can't accept your file: the offered address isn't yours.")
+		return
+	}
+
+	channel := channels[0]
+	tgChan, ok := config.GetTelegramChannel(channel)
+	if !ok {
+		return
+	}
+
+	file, size, err := receiveDCC(offer)
+	if err != nil {
+		logf("[DEBUG] DCC transfer of %s from %s failed: %s\n", offer.FileName, nick, err)
+		irc.Noticef(nick, "Receiving %s failed: %s", offer.FileName, err)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	caption := fmt.Sprintf(IRCMsgFormat, nick, decodeIRC(offer.FileName))
+	id, err := SendTelegramDocument(tgChan.Sender, caption, 0, offer.FileName, file)
+	if err != nil {
+		logf("[DEBUG] Failed to send %s from %s to Telegram: %s\n", offer.FileName, nick, err)
+		irc.Noticef(nick, "Sending %s to Telegram failed.", offer.FileName)
+		return
+	}
+
+	now := time.Now()
+	if chat, err := strconv.ParseInt(tgChan.Sender, 10, 64); err == nil {
+		StoreMapping(&MessageMapping{
+			TelegramChat: chat,
+			TelegramID:   id,
+			IRCChannel:   channel,
+			IRCNick:      nick,
+			IRCTime:      now.Unix(),
+			FromIRC:      true,
+		})
+	}
+	// Type>Timestamp|Nick|FileName|Size
+	logf("DCC>%[1]d|%[2]s|%[3]s|%[4]d\n", now.Unix(), nick, offer.FileName, size)
+}
+
+// receiveDCC connects to the sender and receives the offered file into a temporary file.
+// The caller must close and remove the returned file.
+func receiveDCC(offer DCCOffer) (*os.File, int64, error) {
+	limit := dccLimit()
+	dialer := &net.Dialer{Timeout: dccTimeout, Control: publicOnly}
+	conn, err := dialer.DialContext(context.Background(), "tcp", offer.Address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	tmp, err := ioutil.TempFile("", "tgirc-dcc-")
+	if err != nil {
+		return nil, 0, err
+	}
+	fail := func(err error) (*os.File, int64, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 32*1024)
+	ack := make([]byte, 4)
+	var total int64
+	for offer.Size <= 0 || total < offer.Size {
+		conn.SetDeadline(time.Now().Add(dccTimeout))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			if total > limit {
+				return fail(fmt.Errorf("file is larger than %s", formatSize(int(limit))))
+			} else if _, werr := tmp.Write(buf[:n]); werr != nil {
+				return fail(werr)
+			}
+			// Acknowledge the number of bytes received so far as required by the DCC protocol
+			binary.BigEndian.PutUint32(ack, uint32(total))
+			if _, werr := conn.Write(ack); werr != nil && err == nil {
+				err = werr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+	}
+
+	if offer.Size > 0 && total != offer.Size {
+		return fail(fmt.Errorf("received %d bytes, expected %d", total, offer.Size))
+	} else if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return tmp, total, nil
+}
@@ -0,0 +1,96 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import "testing"
+
+func TestParseDCCSend(t *testing.T) {
+	tests := []struct {
+		name  string
+		ctcp  string
+		offer DCCOffer
+		err   bool
+	}{
+		{"numeric address", "DCC SEND file.txt 3232235521 5000 1234",
+			DCCOffer{FileName: "file.txt", Address: "192.168.0.1:5000", Size: 1234}, false},
+		{"dotted address", "DCC SEND file.txt 203.0.113.7 5000 10",
+			DCCOffer{FileName: "file.txt", Address: "203.0.113.7:5000", Size: 10}, false},
+		{"IPv6 address", "DCC SEND file.txt 2001:db8::1 5000 10",
+			DCCOffer{FileName: "file.txt", Address: "[2001:db8::1]:5000", Size: 10}, false},
+		{"quoted file name", `DCC SEND "my file.txt" 3232235521 5000 1234`,
+			DCCOffer{FileName: "my file.txt", Address: "192.168.0.1:5000", Size: 1234}, false},
+		{"quoted file name with path", `DCC SEND "../../etc/passwd" 3232235521 5000 1`,
+			DCCOffer{FileName: "passwd", Address: "192.168.0.1:5000", Size: 1}, false},
+		{"file name with path", `DCC SEND /tmp/a.txt 3232235521 5000 1`,
+			DCCOffer{FileName: "a.txt", Address: "192.168.0.1:5000", Size: 1}, false},
+		{"no size", "DCC SEND file.txt 3232235521 5000",
+			DCCOffer{FileName: "file.txt", Address: "192.168.0.1:5000"}, false},
+		{"extra fields", "DCC SEND file.txt 3232235521 5000 10 token",
+			DCCOffer{FileName: "file.txt", Address: "192.168.0.1:5000", Size: 10}, false},
+
+		{"not DCC SEND", "DCC CHAT chat 3232235521 5000", DCCOffer{}, true},
+		{"unterminated quote", `DCC SEND "file.txt 3232235521 5000 1`, DCCOffer{}, true},
+		{"empty quoted name", `DCC SEND "" 3232235521 5000 1`, DCCOffer{}, true},
+		{"missing address", "DCC SEND file.txt", DCCOffer{}, true},
+		{"missing port", "DCC SEND file.txt 3232235521", DCCOffer{}, true},
+		{"quoted name without address", `DCC SEND "file.txt"`, DCCOffer{}, true},
+		{"numeric address out of range", "DCC SEND file.txt 4294967296 5000 1", DCCOffer{}, true},
+		{"invalid address", "DCC SEND file.txt example.com 5000 1", DCCOffer{}, true},
+		{"port out of range", "DCC SEND file.txt 3232235521 65536 1", DCCOffer{}, true},
+		{"negative port", "DCC SEND file.txt 3232235521 -1 1", DCCOffer{}, true},
+		{"passive DCC", "DCC SEND file.txt 3232235521 0 1 7", DCCOffer{}, true},
+		{"invalid port", "DCC SEND file.txt 3232235521 port 1", DCCOffer{}, true},
+		{"negative size", "DCC SEND file.txt 3232235521 5000 -1", DCCOffer{}, true},
+		{"size out of range", "DCC SEND file.txt 3232235521 5000 99999999999999999999", DCCOffer{}, true},
+		{"invalid size", "DCC SEND file.txt 3232235521 5000 big", DCCOffer{}, true},
+	}
+
+	for _, test := range tests {
+		offer, err := ParseDCCSend(test.ctcp)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, offer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if offer != test.offer {
+			t.Errorf("%s: got %+v, expected %+v", test.name, offer, test.offer)
+		}
+	}
+}
+
+func TestDCCFromHost(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+		ok      bool
+	}{
+		{"192.168.0.1:5000", "192.168.0.1", true},
+		{"192.168.0.1:5000", "192.168.0.2", false},
+		{"192.168.0.1:5000", "::ffff:192.168.0.1", true},
+		{"[2001:db8::1]:5000", "2001:db8::1", true},
+		{"[2001:db8::1]:5000", "2001:db8::2", false},
+		{"invalid", "192.168.0.1", false},
+	}
+
+	for _, test := range tests {
+		if ok := dccFromHost(DCCOffer{Address: test.address}, test.host); ok != test.ok {
+			t.Errorf("dccFromHost(%s, %s) = %t, expected %t", test.address, test.host, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeleteCommand is the Telegram command admins can reply to a message with to delete it.
+// The Bot API doesn't tell bots when messages are deleted in groups, so deletions made
+// with this command are the only ones the bridge can log and relay.
+const DeleteCommand = "/delete"
+
+// isCommand checks if the message is the given bot command, optionally addressed to the bridge bot
+func isCommand(message Message, command string) bool {
+	fields := strings.Fields(message.Text)
+	if len(fields) == 0 {
+		return false
+	}
+	name := fields[0]
+	if i := strings.IndexRune(name, '@'); i >= 0 {
+		if !strings.EqualFold(name[i+1:], botUser.Username) {
+			return false
+		}
+		name = name[:i]
+	}
+	return name == command
+}
+
+// telegramDeleteCommand deletes the message an admin replied to with the delete command, along with the command itself
+func telegramDeleteCommand(message Message) {
+	if message.ReplyTo == nil {
+		commandError(message, DeleteCommand, "Reply to the message you want to delete with "+DeleteCommand)
+		return
+	}
+	admin, err := IsTelegramAdmin(message.Chat.ID, message.Sender.ID)
+	if err != nil {
+		logf("[DEBUG] Failed to check admin status of %d: %s\n", message.Sender.ID, err)
+		commandError(message, DeleteCommand, "Couldn't check if you're an admin")
+		return
+	} else if !admin {
+		commandError(message, DeleteCommand, "Only admins can delete messages")
+		return
+	}
+
+	if err = DeleteTelegramMessage(message.Chat.ID, message.ReplyTo.ID); err != nil {
+		logf("[DEBUG] Failed to delete message %d: %s\n", message.ReplyTo.ID, err)
+		commandError(message, DeleteCommand, "Couldn't delete the message. Is the bot an admin?")
+		return
+	}
+	if err = DeleteTelegramMessage(message.Chat.ID, message.ID); err != nil {
+		logf("[DEBUG] Failed to delete delete command %d: %s\n", message.ID, err)
+	}
+	telegramDeleted(message.Chat.ID, message.ReplyTo.ID, telegramUsername(message))
+}
+
+// commandError logs a failed bot command and tells the user why it failed
+func commandError(message Message, command, reason string) {
+	logf("[DEBUG] %s by %s in %d failed: %s\n", command, telegramUsername(message), message.Chat.ID, reason)
+	if _, err := SendTelegramMessage(strconv.FormatInt(message.Chat.ID, 10), decodeIRC(reason), message.ID); err != nil {
+		logf("[DEBUG] Failed to send message to Telegram: %s\n", err)
+	}
+}
+
+// telegramDeleted logs the deletion of the given Telegram message and notifies IRC if enabled.
+// deletedBy is the name of the user who deleted the message.
+func telegramDeleted(chat int64, id int, deletedBy string) {
+	channel, ok := config.GetIRCChannel(strconv.FormatInt(chat, 10))
+	if !ok {
+		logf("Unidentified Telegram group: %d\n", chat)
+		return
+	}
+
+	mapping, found := DeleteMapping(chat, id)
+	var sender string
+	if found {
+		sender = mapping.IRCNick
+	}
+
+	// Type>ID|Timestamp|DeletedBy|OriginalSender
+	logf("DELETE>%[1]d|%[2]d|%[3]s|%[4]s\n", id, time.Now().Unix(), deletedBy, sender)
+
+	if found && config.GetOptions(channel).NotifyDeletions {
+		irc.Noticef(channel, "[message from %s deleted by %s]", formatNick(channel, sender), formatNick(channel, deletedBy))
+	}
+}
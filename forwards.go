@@ -0,0 +1,115 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Forward origin types
+const (
+	OriginUser       = "user"
+	OriginHiddenUser = "hidden_user"
+	OriginChat       = "chat"
+	OriginChannel    = "channel"
+)
+
+// MessageOrigin describes where a forwarded message originally came from
+type MessageOrigin struct {
+	Type            string `json:"type"`
+	Date            int    `json:"date"`
+	SenderUser      User   `json:"sender_user"`
+	SenderUserName  string `json:"sender_user_name"`
+	SenderChat      Chat   `json:"sender_chat"`
+	Chat            Chat   `json:"chat"`
+	AuthorSignature string `json:"author_signature"`
+}
+
+// Name returns the display name of the origin. Messages from chats and channels include the author's signature if there is one.
+func (origin MessageOrigin) Name() string {
+	var name string
+	switch origin.Type {
+	case OriginUser:
+		return fullName(origin.SenderUser)
+	case OriginHiddenUser:
+		return origin.SenderUserName
+	case OriginChat:
+		name = origin.SenderChat.Title
+	case OriginChannel:
+		name = origin.Chat.Title
+	}
+	if len(origin.AuthorSignature) > 0 {
+		return fmt.Sprintf("%s (%s)", name, origin.AuthorSignature)
+	}
+	return name
+}
+
+// ID returns the ID of the original sender or chat. Hidden users don't have an ID.
+func (origin MessageOrigin) ID() int64 {
+	switch origin.Type {
+	case OriginUser:
+		return int64(origin.SenderUser.ID)
+	case OriginChat:
+		return origin.SenderChat.ID
+	case OriginChannel:
+		return origin.Chat.ID
+	}
+	return 0
+}
+
+// Origin returns the origin of a forwarded message. Messages from older
+// Bot API versions without forward_origin use the separate forward fields.
+func (message Message) Origin() MessageOrigin {
+	if message.ForwardOrigin != nil {
+		return *message.ForwardOrigin
+	}
+
+	origin := MessageOrigin{Date: message.OriginalUnixtime, AuthorSignature: message.ForwardSignature}
+	if message.OriginalChat.ID != 0 {
+		origin.Chat = message.OriginalChat
+		origin.Type = OriginChannel
+		if message.OriginalChat.Type != "channel" {
+			origin.SenderChat = message.OriginalChat
+			origin.Type = OriginChat
+		}
+	} else if message.OriginalSender.ID != 0 {
+		origin.Type = OriginUser
+		origin.SenderUser = message.OriginalSender
+	} else if len(message.ForwardSenderName) > 0 {
+		origin.Type = OriginHiddenUser
+		origin.SenderUserName = message.ForwardSenderName
+	}
+	return origin
+}
+
+// IsForwarded checks if the message was forwarded, including forwards from users who hide their account
+func (message Message) IsForwarded() bool {
+	return message.ForwardOrigin != nil || message.OriginalSender.ID != 0 ||
+		message.OriginalChat.ID != 0 || len(message.ForwardSenderName) > 0
+}
+
+// fullName returns the first and last name of the user, falling back to the username or ID
+func fullName(user User) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if len(name) > 0 {
+		return name
+	} else if len(user.Username) > 0 {
+		return user.Username
+	}
+	return strconv.Itoa(user.ID)
+}
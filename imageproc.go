@@ -0,0 +1,414 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxPixels is the largest image that is decoded for re-encoding. Image headers can declare
+// huge dimensions in a tiny file, and decoding allocates memory for every pixel.
+const maxPixels = 50 * 1000 * 1000
+
+// processImage prepares an image for uploading to the given store. Location and other metadata
+// is stripped, images larger than the configured maximum dimension are downsized and formats
+// that the store doesn't support are converted. If the image can't be decoded, it's returned as-is.
+func processImage(data []byte, mime string, store MediaStore) ([]byte, string) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		logf("[DEBUG] Failed to decode image: %s\n", err)
+		return data, mime
+	}
+
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		logf("[DEBUG] Not re-encoding %dx%d image, as it's larger than %d pixels\n", cfg.Width, cfg.Height, maxPixels)
+		return stripMetadata(data, format), mime
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	maxDim := config.Images.MaxDimension
+	tooLarge := maxDim > 0 && (cfg.Width > maxDim || cfg.Height > maxDim)
+	// Resizing would drop all but the first frame of animated GIFs
+	if tooLarge && format == "gif" && isAnimatedGIF(data) {
+		tooLarge = false
+	}
+
+	if store.SupportsMime(mime) && orientation == 1 && !tooLarge {
+		return stripMetadata(data, format), mime
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		logf("[DEBUG] Failed to decode image: %s\n", err)
+		return data, mime
+	}
+	img = orient(img, orientation)
+	if tooLarge {
+		img = downsize(img, maxDim)
+	}
+
+	encoded, encodedMime, err := encodeImage(img, mime, store)
+	if err != nil {
+		logf("[DEBUG] Failed to encode image: %s\n", err)
+		return data, mime
+	}
+	return encoded, encodedMime
+}
+
+// encodeImage encodes the image in the given format, or a format the store supports
+func encodeImage(img image.Image, mime string, store MediaStore) ([]byte, string, error) {
+	// There's no WebP encoder, so re-encoded WebP images become PNGs to keep transparency
+	if mime == "image/webp" {
+		mime = "image/png"
+	}
+	if !store.SupportsMime(mime) {
+		mime = "image/jpeg"
+		if !isOpaque(img) && store.SupportsMime("image/png") {
+			mime = "image/png"
+		}
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch mime {
+	case "image/png":
+		err = png.Encode(&buf, img)
+	case "image/gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		mime = "image/jpeg"
+		quality := config.Images.JPEGQuality
+		if quality <= 0 || quality > 100 {
+			quality = 90
+		}
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality})
+	}
+	return buf.Bytes(), mime, err
+}
+
+func isOpaque(img image.Image) bool {
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); ok {
+		return opaque.Opaque()
+	}
+	return false
+}
+
+// flatten draws the image on a white background, as JPEG doesn't support transparency
+func flatten(img image.Image) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Over)
+	return out
+}
+
+// downsize scales the image so that neither dimension is larger than max
+func downsize(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= max && height <= max {
+		return img
+	}
+	if width > height {
+		width, height = max, height*max/width
+	} else {
+		width, height = width*max/height, max
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(out, out.Bounds(), img, bounds, draw.Src, nil)
+	return out
+}
+
+// orient rotates and flips the image according to its EXIF orientation
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	var out *image.RGBA
+	if orientation >= 5 {
+		out = image.NewRGBA(image.Rect(0, 0, height, width))
+	} else {
+		out = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Flipped horizontally
+				dx, dy = width-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // Flipped vertically
+				dx, dy = x, height-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise
+				dx, dy = height-1-y, x
+			case 7: // Transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // Rotated 90° counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			out.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// isAnimatedGIF checks if the GIF has more than one frame by scanning its blocks, without decoding the frames
+func isAnimatedGIF(data []byte) bool {
+	// Skip the header, logical screen descriptor and global colour table
+	if len(data) < 13 {
+		return false
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (uint(data[10]&7) + 1)
+	}
+
+	var frames int
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// Extensions have a label followed by data sub-blocks
+			pos = skipGIFSubBlocks(data, pos+2)
+		case 0x2C:
+			frames++
+			if frames > 1 {
+				return true
+			} else if pos+10 > len(data) {
+				return false
+			}
+			// Image descriptor, local colour table, LZW code size and image data sub-blocks
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (uint(packed&7) + 1)
+			}
+			pos = skipGIFSubBlocks(data, pos+1)
+		default:
+			// Trailer or malformed data
+			return false
+		}
+	}
+	return false
+}
+
+// skipGIFSubBlocks returns the position after the data sub-blocks starting at pos
+func skipGIFSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos += size + 1
+		if size == 0 {
+			return pos
+		}
+	}
+	return len(data)
+}
+
+// stripMetadata removes EXIF, XMP and text metadata from the image without re-encoding it
+func stripMetadata(data []byte, format string) []byte {
+	var stripped []byte
+	switch format {
+	case "jpeg":
+		stripped = stripJPEG(data)
+	case "png":
+		stripped = stripPNG(data)
+	case "webp":
+		stripped = stripWebP(data)
+	default:
+		return data
+	}
+	if stripped == nil {
+		// The file is malformed, so let the upload target deal with it
+		return data
+	}
+	return stripped
+}
+
+// stripJPEG removes APP1 (EXIF and XMP), APP13 (IPTC) and comment segments from a JPEG
+func stripJPEG(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+
+	out := []byte{0xFF, 0xD8}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			// Markers may be preceded by any number of fill bytes
+			i++
+			continue
+		} else if marker == 0xDA {
+			// Start of scan, the rest is image data
+			return append(out, data[i:]...)
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return nil
+}
+
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// stripPNG removes EXIF, text and timestamp chunks from a PNG
+func stripPNG(data []byte) []byte {
+	const header = "\x89PNG\r\n\x1a\n"
+	if len(data) < len(header) || string(data[:len(header)]) != header {
+		return nil
+	}
+
+	out := []byte(header)
+	for i := len(header); i < len(data); {
+		if i+8 > len(data) {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out
+}
+
+// stripWebP removes EXIF and XMP chunks from a WebP
+func stripWebP(data []byte) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+
+	out := append([]byte{}, data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil
+		}
+		fourcc := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + length + length%2
+		if length < 0 || end > len(data) {
+			return nil
+		}
+		if fourcc == "VP8X" && length > 0 {
+			chunk := append([]byte{}, data[i:end]...)
+			// Clear the EXIF and XMP flags
+			chunk[8] &^= 0x08 | 0x04
+			out = append(out, chunk...)
+		} else if fourcc != "EXIF" && fourcc != "XMP " {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG. 1 is returned if there's no orientation.
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if marker == 0xDA || length < 2 || end > len(data) {
+			break
+		}
+		if marker == 0xE1 && length > 8 && string(data[i+4:i+10]) == "Exif\x00\x00" {
+			return exifOrientation(data[i+10 : end])
+		}
+		i = end
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of TIFF-formatted EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
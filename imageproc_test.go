@@ -0,0 +1,379 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+// jpegSegment returns a JPEG marker segment with the given payload
+func jpegSegment(marker byte, payload string) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// exifTIFF returns TIFF-formatted EXIF data whose first IFD contains an orientation tag
+func exifTIFF(order binary.ByteOrder, orientation int) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+	return tiff
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+func TestStripJPEG(t *testing.T) {
+	soi := []byte{0xFF, 0xD8}
+	app0 := jpegSegment(0xE0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	exif := jpegSegment(0xE1, "Exif\x00\x00"+string(exifTIFF(binary.BigEndian, 6)))
+	xmp := jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")
+	iptc := jpegSegment(0xED, "Photoshop 3.0\x00")
+	comment := jpegSegment(0xFE, "GPS 60.1699 N")
+	dqt := jpegSegment(0xDB, "\x00"+string(make([]byte, 64)))
+	scan := concat(jpegSegment(0xDA, "\x01\x01\x00\x00\x3F\x00"), []byte{0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD9})
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []byte
+	}{
+		{"no metadata", concat(soi, app0, dqt, scan), concat(soi, app0, dqt, scan)},
+		{"metadata", concat(soi, app0, exif, xmp, iptc, comment, dqt, scan), concat(soi, app0, dqt, scan)},
+		{"fill bytes", concat(soi, []byte{0xFF, 0xFF}, exif, dqt, scan), concat(soi, dqt, scan)},
+		{"metadata after scan is image data", concat(soi, scan, comment), concat(soi, scan, comment)},
+
+		{"empty", nil, nil},
+		{"not a JPEG", []byte("GIF89a...."), nil},
+		{"only SOI", soi, nil},
+		{"no scan", concat(soi, app0, dqt), nil},
+		{"truncated segment", concat(soi, app0, exif[:10]), nil},
+		{"truncated length", concat(soi, app0, []byte{0xFF, 0xE1, 0x01}), nil},
+		{"length too small", concat(soi, []byte{0xFF, 0xE1, 0x00, 0x01}, scan), nil},
+		{"garbage between segments", concat(soi, app0, []byte{0x00}, dqt, scan), nil},
+	}
+
+	for _, test := range tests {
+		if stripped := stripJPEG(test.data); !bytes.Equal(stripped, test.expected) {
+			t.Errorf("%s: got %x, expected %x", test.name, stripped, test.expected)
+		}
+	}
+}
+
+// pngChunk returns a PNG chunk with the given type and payload
+func pngChunk(typ, payload string) []byte {
+	chunk := make([]byte, 4, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, payload...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE([]byte(typ+payload)))
+	return append(chunk, crc...)
+}
+
+func TestStripPNG(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.NRGBA{255, 0, 0, 128})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	clean := buf.Bytes()
+	// The IEND chunk is always the last 12 bytes
+	body, iend := clean[:len(clean)-12], clean[len(clean)-12:]
+	metadata := concat(
+		pngChunk("tEXt", "Comment\x00hello"),
+		pngChunk("zTXt", "Comment\x00\x00x"),
+		pngChunk("iTXt", "Comment\x00\x00\x00\x00\x00hello"),
+		pngChunk("eXIf", string(exifTIFF(binary.LittleEndian, 1))),
+		pngChunk("tIME", "\x07\xE0\x01\x01\x00\x00\x00"),
+	)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []byte
+	}{
+		{"no metadata", clean, clean},
+		{"metadata", concat(body, metadata, iend), clean},
+
+		{"empty", nil, nil},
+		{"not a PNG", []byte("\x89PNX\r\n\x1a\n"), nil},
+		{"truncated chunk header", concat(body, iend[:6]), nil},
+		{"truncated chunk", concat(body, iend[:10]), nil},
+		{"chunk longer than file", concat(body, []byte{0xFF, 0xFF, 0xFF, 0xFF}, []byte("tEXt")), nil},
+	}
+
+	for _, test := range tests {
+		if stripped := stripPNG(test.data); !bytes.Equal(stripped, test.expected) {
+			t.Errorf("%s: got %x, expected %x", test.name, stripped, test.expected)
+		}
+	}
+
+	if _, err := png.Decode(bytes.NewReader(stripPNG(concat(body, metadata, iend)))); err != nil {
+		t.Errorf("stripped PNG can't be decoded: %s", err)
+	}
+}
+
+// riffChunk returns a RIFF chunk with the given FourCC and payload, padded to an even length
+func riffChunk(fourcc, payload string) []byte {
+	chunk := make([]byte, 8, 9+len(payload))
+	copy(chunk, fourcc)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := concat(chunks...)
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+len(body)))
+	copy(header[8:], "WEBP")
+	return append(header, body...)
+}
+
+func TestStripWebP(t *testing.T) {
+	vp8x := func(flags byte) []byte {
+		return riffChunk("VP8X", string([]byte{flags, 0, 0, 0, 1, 0, 0, 1, 0, 0}))
+	}
+	image := riffChunk("VP8L", "\x2f\x00\x00\x00\x00")
+	exif := riffChunk("EXIF", string(exifTIFF(binary.LittleEndian, 3)))
+	xmp := riffChunk("XMP ", "<x:xmpmeta/>")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []byte
+	}{
+		{"simple", webpFile(image), webpFile(image)},
+		{"metadata", webpFile(vp8x(0x10|0x08|0x04), image, exif, xmp), webpFile(vp8x(0x10), image)},
+		{"odd chunk padding", webpFile(riffChunk("ICCP", "abc"), image), webpFile(riffChunk("ICCP", "abc"), image)},
+
+		{"empty", nil, nil},
+		{"not RIFF", []byte("RIFX\x00\x00\x00\x00WEBP"), nil},
+		{"not WebP", []byte("RIFF\x04\x00\x00\x00WAVE"), nil},
+		{"truncated chunk header", webpFile(image)[:16], nil},
+		{"truncated chunk", webpFile(image)[:22], nil},
+		{"chunk longer than file", webpFile([]byte("EXIF\xFF\xFF\xFF\xFF")), nil},
+	}
+
+	for _, test := range tests {
+		if stripped := stripWebP(test.data); !bytes.Equal(stripped, test.expected) {
+			t.Errorf("%s: got %x, expected %x", test.name, stripped, test.expected)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		for orientation := 1; orientation <= 8; orientation++ {
+			if got := exifOrientation(exifTIFF(order, orientation)); got != orientation {
+				t.Errorf("%s orientation %d: got %d", order, orientation, got)
+			}
+		}
+	}
+
+	noTag := exifTIFF(binary.BigEndian, 6)
+	binary.BigEndian.PutUint16(noTag[10:], 0x0110)
+	badOffset := exifTIFF(binary.LittleEndian, 6)
+	binary.LittleEndian.PutUint32(badOffset[4:], 0xFFFFFFF0)
+	tooManyEntries := exifTIFF(binary.BigEndian, 6)
+	binary.BigEndian.PutUint16(tooManyEntries[8:], 100)
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"empty", nil, 1},
+		{"truncated header", exifTIFF(binary.BigEndian, 6)[:6], 1},
+		{"truncated entry", exifTIFF(binary.BigEndian, 6)[:18], 1},
+		{"invalid byte order", append([]byte("XX"), exifTIFF(binary.BigEndian, 6)[2:]...), 1},
+		{"no orientation tag", noTag, 1},
+		{"offset out of range", badOffset, 1},
+		{"more entries than data", tooManyEntries, 6},
+		{"orientation 0", exifTIFF(binary.BigEndian, 0), 1},
+		{"orientation 9", exifTIFF(binary.LittleEndian, 9), 1},
+	}
+	for _, test := range tests {
+		if got := exifOrientation(test.tiff); got != test.want {
+			t.Errorf("%s: got %d, expected %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	soi := []byte{0xFF, 0xD8}
+	app0 := jpegSegment(0xE0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	scan := jpegSegment(0xDA, "\x01\x01\x00\x00\x3F\x00")
+	exif := func(order binary.ByteOrder, orientation int) []byte {
+		return jpegSegment(0xE1, "Exif\x00\x00"+string(exifTIFF(order, orientation)))
+	}
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		for orientation := 1; orientation <= 8; orientation++ {
+			data := concat(soi, app0, exif(order, orientation), scan)
+			if got := jpegOrientation(data); got != orientation {
+				t.Errorf("%s orientation %d: got %d", order, orientation, got)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no EXIF", concat(soi, app0, scan), 1},
+		{"XMP only", concat(soi, jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00"), scan), 1},
+		{"fill bytes", concat(soi, []byte{0xFF}, exif(binary.BigEndian, 8), scan), 8},
+		{"EXIF after scan", concat(soi, scan, exif(binary.BigEndian, 6)), 1},
+		{"truncated EXIF", concat(soi, exif(binary.BigEndian, 6))[:12], 1},
+		{"short EXIF segment", concat(soi, jpegSegment(0xE1, "Exif"), scan), 1},
+		{"empty", nil, 1},
+	}
+	for _, test := range tests {
+		if got := jpegOrientation(test.data); got != test.want {
+			t.Errorf("%s: got %d, expected %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// A B C
+	// D E F
+	letters := "ABCDEF"
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range letters {
+		src.SetGray(i%3, i/3, color.Gray{letters[i]})
+	}
+
+	tests := []struct {
+		orientation int
+		rows        []string
+	}{
+		{1, []string{"ABC", "DEF"}},
+		{2, []string{"CBA", "FED"}},
+		{3, []string{"FED", "CBA"}},
+		{4, []string{"DEF", "ABC"}},
+		{5, []string{"AD", "BE", "CF"}},
+		{6, []string{"DA", "EB", "FC"}},
+		{7, []string{"FC", "EB", "DA"}},
+		{8, []string{"CF", "BE", "AD"}},
+	}
+	for _, test := range tests {
+		out := orient(src, test.orientation)
+		bounds := out.Bounds()
+		var rows []string
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			var row []byte
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				row = append(row, color.GrayModel.Convert(out.At(x, y)).(color.Gray).Y)
+			}
+			rows = append(rows, string(row))
+		}
+		if len(rows) != len(test.rows) {
+			t.Errorf("orientation %d: got %v, expected %v", test.orientation, rows, test.rows)
+			continue
+		}
+		for i := range rows {
+			if rows[i] != test.rows[i] {
+				t.Errorf("orientation %d: got %v, expected %v", test.orientation, rows, test.rows)
+				break
+			}
+		}
+	}
+}
+
+func TestIsAnimatedGIF(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	frame := func() *image.Paletted { return image.NewPaletted(image.Rect(0, 0, 4, 4), palette) }
+	encode := func(anim *gif.GIF) []byte {
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, anim); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	single := encode(&gif.GIF{Image: []*image.Paletted{frame()}, Delay: []int{0}})
+	animated := encode(&gif.GIF{Image: []*image.Paletted{frame(), frame()}, Delay: []int{10, 10}, LoopCount: 0})
+	// Frames with their own palette have a local colour table
+	local := frame()
+	local.Palette = color.Palette{color.White, color.Black, color.Gray{128}}
+	localTables := encode(&gif.GIF{Image: []*image.Paletted{local, frame()}, Delay: []int{10, 10}})
+
+	tests := []struct {
+		name     string
+		data     []byte
+		animated bool
+	}{
+		{"single frame", single, false},
+		{"two frames", animated, true},
+		{"local colour tables", localTables, true},
+		{"truncated after first frame", animated[:len(animated)/2+10], false},
+		{"truncated header", animated[:10], false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		if animated := isAnimatedGIF(test.data); animated != test.animated {
+			t.Errorf("%s: got %t, expected %t", test.name, animated, test.animated)
+		}
+	}
+}
+
+func TestProcessImageHugeDimensions(t *testing.T) {
+	config = &Config{}
+	config.Images.MaxDimension = 1000
+	defer func() { config = nil }()
+
+	// A few bytes declaring a 100000x100000 image that would take 40 GB to decode
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	ihdr[8], ihdr[9] = 8, 6
+	data := concat([]byte("\x89PNG\r\n\x1a\n"), pngChunk("IHDR", string(ihdr)), pngChunk("IEND", ""))
+
+	result, mime := processImage(data, "image/png", &LocalStore{})
+	if !bytes.Equal(result, data) || mime != "image/png" {
+		t.Errorf("huge image was changed: %d bytes of %s", len(result), mime)
+	}
+}
@@ -17,20 +17,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"image"
-	_ "image"
-	_ "image/gif"
-	"image/jpeg"
-	_ "image/png"
+	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
-
-	_ "golang.org/x/image/webp"
 )
 
 // Telegram API constants
@@ -39,10 +36,20 @@ const (
 	DownloadFile = "https://api.telegram.org/file/bot%s/%s"
 )
 
+// Download settings
+const (
+	downloadAttempts = 3
+	downloadTimeout  = 60 * time.Second
+)
+
+var downloadClient = &http.Client{Timeout: downloadTimeout}
+
 // Result ...
 type Result struct {
-	OK     bool `json:"ok"`
-	Result File `json:"result"`
+	OK          bool   `json:"ok"`
+	Result      File   `json:"result"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
 }
 
 // File ...
@@ -52,37 +59,128 @@ type File struct {
 	Path string `json:"file_path"`
 }
 
-// Download downloads the given file
-func Download(name string) []byte {
-	resp, err := http.DefaultClient.Get(fmt.Sprintf(DownloadFile, config.Telegram.Token, name))
-	if err != nil {
-		return []byte{}
-	}
+// permanentError is an error that won't go away by retrying
+type permanentError struct {
+	error
+}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return []byte{}
-	}
+// transientStatus checks if a request that failed with the given HTTP status code should be retried
+func transientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
 
-	return data
+// withRetries calls fn until it succeeds, returns a permanentError or runs out of attempts
+func withRetries(ctx context.Context, what string, fn func() error) error {
+	delay := 1 * time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		} else if perm, ok := err.(permanentError); ok {
+			return perm.error
+		} else if attempt >= downloadAttempts {
+			return err
+		}
+
+		logf("[DEBUG] %s failed (attempt %d/%d): %s\n", what, attempt, downloadAttempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
 }
 
-// CreateDownload calls the getFile method in the Telegram API
-func CreateDownload(id string) string {
-	resp, err := http.DefaultClient.Get(fmt.Sprintf(GetFile, config.Telegram.Token, id))
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return ""
+		return nil, permanentError{hideToken(err)}
 	}
+	resp, err := downloadClient.Do(req.WithContext(ctx))
+	return resp, hideToken(err)
+}
 
-	var data = Result{}
+// CreateDownload calls the getFile method in the Telegram API and returns the path to download the file from.
+// If maxSize is positive, files larger than it are rejected.
+func CreateDownload(ctx context.Context, id string, maxSize int64) (string, error) {
+	var path string
+	err := withRetries(ctx, "getFile "+id, func() error {
+		resp, err := get(ctx, fmt.Sprintf(GetFile, config.Telegram.Token, url.QueryEscape(id)))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		var data = Result{}
+		dec := json.NewDecoder(resp.Body)
+		err = dec.Decode(&data)
+		if err != nil {
+			return fmt.Errorf("failed to decode getFile response (%s): %s", resp.Status, err)
+		} else if !data.OK {
+			err = fmt.Errorf("getFile failed: %d %s", data.ErrorCode, data.Description)
+			if transientStatus(data.ErrorCode) {
+				return err
+			}
+			return permanentError{err}
+		} else if maxSize > 0 && int64(data.Result.Size) > maxSize {
+			return permanentError{fmt.Errorf("file is too large (%d bytes)", data.Result.Size)}
+		}
 
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&data)
-	if err != nil {
-		return ""
-	}
+		path = data.Result.Path
+		return nil
+	})
+	return path, err
+}
+
+// Download streams the given file to a temporary file and returns it along with its size.
+// If maxSize is positive, the download is aborted if the file is larger than it.
+// The caller must close and remove the returned file.
+func Download(ctx context.Context, path string, maxSize int64) (*os.File, int64, error) {
+	var file *os.File
+	var size int64
+	err := withRetries(ctx, "Download "+path, func() error {
+		resp, err := get(ctx, fmt.Sprintf(DownloadFile, config.Telegram.Token, path))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+			if transientStatus(resp.StatusCode) {
+				return err
+			}
+			return permanentError{err}
+		} else if maxSize > 0 && resp.ContentLength > maxSize {
+			return permanentError{fmt.Errorf("file is too large (%d bytes)", resp.ContentLength)}
+		}
 
-	return data.Result.Path
+		tmp, err := ioutil.TempFile("", "tgirc-")
+		if err != nil {
+			return permanentError{err}
+		}
+		var body io.Reader = resp.Body
+		if maxSize > 0 {
+			body = io.LimitReader(resp.Body, maxSize+1)
+		}
+		n, err := io.Copy(tmp, body)
+		if err == nil && maxSize > 0 && n > maxSize {
+			err = permanentError{fmt.Errorf("file is larger than %d bytes", maxSize)}
+		}
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+
+		file, size = tmp, n
+		return nil
+	})
+	return file, size, err
 }
 
 // MISData ...
@@ -101,34 +199,49 @@ type MISResponse struct {
 	Success bool `json:"success"`
 }
 
-// MISUpload ...
-func MISUpload(data []byte) string {
-	if len(data) == 0 {
-		return ""
+// MISStore uploads images to a MIS server
+type MISStore struct{}
+
+// SupportsMime checks if MIS can store files of the given type
+func (store *MISStore) SupportsMime(mime string) bool {
+	return mime == "image/jpeg" || mime == "image/png" || mime == "image/gif"
+}
+
+// Upload uploads the given image to MIS
+func (store *MISStore) Upload(ctx context.Context, file io.ReadSeeker, size int64, mime string) (string, error) {
+	if !store.SupportsMime(mime) {
+		return "", fmt.Errorf("MIS doesn't support %s", mime)
 	}
 
-	if http.DetectContentType(data) != "image/jpeg" {
-		data = imageToJPG(data)
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
 	}
 
+	format := strings.TrimPrefix(mediaExtension(mime), ".")
 	var dat = &MISData{
 		Image:     base64.StdEncoding.EncodeToString(data),
-		Name:      ImageName(5),
-		Format:    "jpg",
+		Name:      RandomName(16),
+		Format:    format,
 		Client:    version,
 		Username:  config.MIS.Username,
 		AuthToken: config.MIS.Password,
 		Hidden:    true,
 	}
 
-	data, err := json.Marshal(dat)
+	data, err = json.Marshal(dat)
 	if err != nil {
-		return ""
+		return "", err
 	}
 
-	resp, err := http.DefaultClient.Post(fmt.Sprintf("%s/%s", config.MIS.Address, "insert"), "text/json", bytes.NewReader(data))
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s", config.MIS.Address, "insert"), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return ""
+		return "", err
 	}
 	defer resp.Body.Close()
 	var r = MISResponse{}
@@ -136,49 +249,7 @@ func MISUpload(data []byte) string {
 	dec.Decode(&r)
 
 	if r.Success {
-		return fmt.Sprintf("%s/%s.jpg", config.MIS.Address, dat.Name)
-	}
-	return ""
-}
-
-const imageNameAC = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ123456789"
-const (
-	letterIdxBits = 6
-	letterIdxMask = 1<<letterIdxBits - 1
-	letterIdxMax  = 63 / letterIdxBits
-)
-
-var src = rand.NewSource(time.Now().UnixNano())
-
-// ImageName generates a string matching [a-zA-Z0-9]{length}
-func ImageName(length int) string {
-	b := make([]byte, length)
-	for i, cache, remain := 4, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(imageNameAC) {
-			b[i] = imageNameAC[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
-	}
-
-	return string(b)
-}
-
-func imageToJPG(data []byte) []byte {
-	img, _, err := image.Decode(bytes.NewReader(data))
-	if err != nil {
-		fmt.Println("Error decoding image:", err)
-		return data
-	}
-	var buf bytes.Buffer
-	err = jpeg.Encode(&buf, img, nil)
-	if err != nil {
-		fmt.Println("Error encoding image:", err)
-		return data
+		return fmt.Sprintf("%s/%s.%s", config.MIS.Address, dat.Name, format), nil
 	}
-	return buf.Bytes()
+	return "", fmt.Errorf("MIS upload failed")
 }
@@ -17,6 +17,7 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -38,39 +39,91 @@ func startIRC() {
 	irc.UseTLS = config.IRC.TLS
 	irc.QuitMessage = "Bridge/logbot shutting down..."
 	irc.Version = version
+	irc.RequestCaps = []string{"message-tags", "server-time", "echo-message"}
 	err := irc.Connect(config.IRC.Address)
 	if err != nil {
-		logf(err.Error())
+		logf("[DEBUG] Error connecting to IRC: %s\n", err)
 	}
 
-	callback := func(channel, nick, message, command string) {
+	callback := func(channel, nick, message, command string, tags map[string]string) {
 		tgChan, ok := config.GetTelegramChannel(channel)
 		if !ok {
 			logf("Unidentified IRC channel: %s\n", channel)
 			return
 		}
 
+		if command == "message" && ircVote(channel, nick, message) {
+			return
+		}
+
 		logFmt := "IRCMESSAGE"
-		if command == "message" {
-			telegram.SendMessage(tgChan, fmt.Sprintf(IRCMsgFormat, nick, decodeIRC(message)), md)
-		} else if command == "action" {
-			telegram.SendMessage(tgChan, fmt.Sprintf(IRCActionFormat, nick, decodeIRC(message)), md)
+		format := IRCMsgFormat
+		if command == "action" {
+			format = IRCActionFormat
 			logFmt = "IRCACTION"
 		}
 
-		logf("%[4]s>%[1]d|%[2]s|%[3]s\n", time.Now().Unix(), nick, message, logFmt)
+		timestamp := ircTime(tags)
+		chat, _ := strconv.ParseInt(tgChan.Sender, 10, 64)
+		text := fmt.Sprintf(format, nick, ircMentions(chat, message))
+		replyTo := replyTarget(channel, message, tags)
+
+		id, err := sendIRCImage(tgChan.Sender, channel, message, command, text, replyTo)
+		if err != nil {
+			if err != errNoImage {
+				logf("[DEBUG] Failed to send image to Telegram: %s\n", err)
+			}
+			id, err = SendTelegramMessage(tgChan.Sender, text, replyTo)
+		}
+		if err != nil {
+			logf("[DEBUG] Failed to send message to Telegram: %s\n", err)
+		} else {
+			StoreMapping(&MessageMapping{
+				TelegramChat: chat,
+				TelegramID:   id,
+				IRCChannel:   channel,
+				IRCMsgID:     tags["msgid"],
+				IRCNick:      nick,
+				IRCTime:      timestamp.Unix(),
+				FromIRC:      true,
+			})
+		}
+
+		logf("%[4]s>%[1]d|%[2]s|%[3]s\n", timestamp.Unix(), nick, message, logFmt)
 	}
 
 	irc.AddCallback("PRIVMSG", func(event *goirc.Event) {
-		callback(event.Arguments[0], event.Nick, event.Message(), "message")
+		if strings.EqualFold(event.Nick, irc.GetNick()) {
+			ircEcho(event.Arguments[0], event.Message(), event.Tags)
+			return
+		}
+		callback(event.Arguments[0], event.Nick, event.Message(), "message", event.Tags)
 	})
 
 	irc.AddCallback("CTCP_ACTION", func(event *goirc.Event) {
-		callback(event.Arguments[0], event.Nick, event.Message(), "action")
+		// The bridge doesn't send actions, but echoes of them shouldn't be relayed either
+		if strings.EqualFold(event.Nick, irc.GetNick()) {
+			return
+		}
+		callback(event.Arguments[0], event.Nick, event.Message(), "action", event.Tags)
+	})
+
+	irc.AddCallback("CTCP", func(event *goirc.Event) {
+		if len(event.Arguments) > 0 && strings.EqualFold(event.Arguments[0], irc.GetNick()) {
+			go dccOffer(event.Nick, event.User, event.Host, event.Message())
+		}
 	})
 
+	irc.AddCallback("TOPIC", func(event *goirc.Event) {
+		if len(event.Arguments) > 0 && event.Nick != irc.GetNick() {
+			go ircTopic(event.Arguments[0], event.Nick, event.Message())
+		}
+	})
+
+	trackMembers()
+
 	irc.AddCallback("001", func(event *goirc.Event) {
-		for key := range config.Mappings {
+		for _, key := range config.IRCChannels() {
 			irc.Join(key)
 		}
 		if len(config.IRC.Password) > 0 {
@@ -87,6 +140,48 @@ func startIRC() {
 	<-quit
 }
 
+// ircEcho handles the echo of a line the bridge sent to IRC. The echo has the message ID the server gave the line,
+// which is saved so that IRCv3 replies to the line can be mapped to the Telegram message it came from.
+func ircEcho(channel, line string, tags map[string]string) {
+	if msgid, ok := tags["msgid"]; ok {
+		StoreIRCMsgID(channel, line, msgid)
+	}
+}
+
+// addressPattern matches IRC messages addressed to a specific nick, e.g. "alice: hello"
+var addressPattern = regexp.MustCompile(`^([^\s:,]+)[:,]\s`)
+
+// replyTarget finds the Telegram message that an IRC message is replying to.
+// IRCv3 reply tags are preferred over nick-prefixed addressing.
+func replyTarget(channel, message string, tags map[string]string) int {
+	for _, tag := range []string{"+draft/reply", "+reply"} {
+		if msgid, ok := tags[tag]; ok {
+			if mapping, ok := MappingByIRC(channel, msgid); ok {
+				return mapping.TelegramID
+			}
+		}
+	}
+
+	if match := addressPattern.FindStringSubmatch(message); match != nil {
+		for _, nick := range nickCandidates(channel, match[1]) {
+			if mapping, ok := LatestByNick(channel, nick); ok {
+				return mapping.TelegramID
+			}
+		}
+	}
+	return 0
+}
+
+// ircTime returns the IRCv3 server-time of a message, or the current time if the server didn't send it
+func ircTime(tags map[string]string) time.Time {
+	if ts, ok := tags["time"]; ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return parsed
+		}
+	}
+	return time.Now()
+}
+
 func decodeIRC(msg string) string {
 	msg = strings.Replace(msg, "*", "\\*", -1)
 	msg = strings.Replace(msg, "_", "\\_", -1)
@@ -95,16 +190,26 @@ func decodeIRC(msg string) string {
 	return msg
 }
 
-func ircmessage(ch int64, user, msg string) {
+func ircmessage(ch int64, user, msg string) (string, bool) {
 	channel, ok := config.GetIRCChannel(strconv.FormatInt(ch, 10))
 	if !ok {
 		logf("Unidentified Telegram group: %d\n", ch)
-		return
+		return "", false
+	}
+
+	for _, line := range ircLines(channel, user, msg) {
+		irc.Privmsg(channel, line)
 	}
+	return channel, true
+}
 
-	for _, line := range Split(msg) {
-		irc.Privmsgf(channel, "<%s> %s", user, line)
+// ircLines returns the lines a message from the given Telegram user is sent to IRC as
+func ircLines(channel, user, msg string) []string {
+	lines := Split(msg)
+	for i, line := range lines {
+		lines[i] = fmt.Sprintf("<%s> %s", formatNick(channel, user), line)
 	}
+	return lines
 }
 
 func stopIRC() {
@@ -0,0 +1,154 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// imageURLPattern matches links that look like direct links to images
+var imageURLPattern = regexp.MustCompile(`(?i)https?://[^\s/]+/\S*\.(?:jpe?g|png|gif|webp)(?:\?\S*)?`)
+
+// errNoImage is returned by sendIRCImage if the message shouldn't be sent as an image
+var errNoImage = errors.New("no image to send")
+
+// publicOnly is a net.Dialer control function that refuses to connect to local and private
+// addresses, so that IRC users can't make the bridge connect to things in its own network.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+	return nil
+}
+
+// imageClient fetches images linked on IRC. It never uses a proxy, as publicOnly would then
+// only see the address of the proxy instead of the server the image is fetched from.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicOnly,
+		}).DialContext,
+	},
+}
+
+func ircImageLimit() int64 {
+	if config.IRCImageLimit > 0 {
+		return int64(config.IRCImageLimit) * 1024
+	}
+	// Telegram doesn't accept photos larger than 10 MB
+	return 10 * 1024 * 1024
+}
+
+// sendIRCImage sends the first image linked in an IRC message to Telegram as a photo with
+// the formatted message as the caption. If the mapping doesn't have IRC images enabled or
+// the message doesn't contain an image link, errNoImage is returned.
+func sendIRCImage(chat, channel, message, command, caption string, replyTo int) (int, error) {
+	if command != "message" || !config.GetOptions(channel).IRCImages {
+		return 0, errNoImage
+	}
+	url := imageURLPattern.FindString(message)
+	if len(url) == 0 {
+		return 0, errNoImage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	data, mime, err := fetchImage(ctx, url)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s: %s", url, err)
+	}
+
+	name := path.Base(strings.SplitN(url, "?", 2)[0])
+	return SendTelegramPhoto(chat, caption, replyTo, name, bytes.NewReader(data), mime == "image/gif")
+}
+
+// fetchImage downloads the image at the given URL after checking its type and size with a HEAD request
+func fetchImage(ctx context.Context, url string) ([]byte, string, error) {
+	limit := ircImageLimit()
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := imageClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	resp.Body.Close()
+	// Some servers don't support HEAD, so only trust successful responses
+	if resp.StatusCode == http.StatusOK {
+		if err = checkImageResponse(resp, limit); err != nil {
+			return nil, "", err
+		}
+	}
+
+	req, err = http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err = imageClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	} else if err = checkImageResponse(resp, limit); err != nil {
+		return nil, "", err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	} else if int64(len(data)) > limit {
+		return nil, "", fmt.Errorf("image is larger than %d bytes", limit)
+	}
+
+	mime := http.DetectContentType(data)
+	if !strings.HasPrefix(mime, "image/") {
+		return nil, "", fmt.Errorf("content is %s, not an image", mime)
+	}
+	return data, mime, nil
+}
+
+func checkImageResponse(resp *http.Response, limit int64) error {
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("content type is %s, not an image", contentType)
+	} else if resp.ContentLength > limit {
+		return fmt.Errorf("image is too large (%d bytes)", resp.ContentLength)
+	}
+	return nil
+}
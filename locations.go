@@ -0,0 +1,118 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Map link templates
+const (
+	GoogleMaps    = "https://maps.google.com/maps?q={lat},{lon}&ll={lat},{lon}&z=16"
+	OpenStreetMap = "https://www.openstreetmap.org/?mlat={lat}&mlon={lon}#map=16/{lat}/{lon}"
+	GeoURI        = "geo:{lat},{lon}"
+)
+
+var mapProviders = map[string]string{
+	"google":        GoogleMaps,
+	"openstreetmap": OpenStreetMap,
+	"osm":           OpenStreetMap,
+	"geo":           GeoURI,
+}
+
+// mapLink returns a link to the given coordinates using the configured map provider
+func mapLink(loc Location) string {
+	template, ok := mapProviders[config.MapURL]
+	if !ok && strings.Contains(config.MapURL, "{lat}") {
+		template = config.MapURL
+	} else if !ok {
+		template = GoogleMaps
+	}
+	return strings.NewReplacer(
+		"{lat}", strconv.FormatFloat(loc.Latitude, 'f', 6, 64),
+		"{lon}", strconv.FormatFloat(loc.Longitude, 'f', 6, 64),
+	).Replace(template)
+}
+
+// locationText returns the IRC text for a location or venue message
+func locationText(message Message) string {
+	if len(message.Venue.Title) > 0 {
+		if len(message.Venue.Address) > 0 {
+			return fmt.Sprintf("[venue] %s, %s: %s", message.Venue.Title, message.Venue.Address, mapLink(message.Venue.Location))
+		}
+		return fmt.Sprintf("[venue] %s: %s", message.Venue.Title, mapLink(message.Venue.Location))
+	} else if message.Location.LivePeriod > 0 {
+		// Updates sent soon after the live location was shared shouldn't be relayed
+		liveLocationsLock.Lock()
+		liveLocations[liveLocationKey(message)] = time.Now()
+		liveLocationsLock.Unlock()
+		return fmt.Sprintf("[live location] %s", mapLink(message.Location))
+	}
+	return mapLink(message.Location)
+}
+
+// liveLocations contains the last time an update of each live location was relayed
+var liveLocations = make(map[string]time.Time)
+var liveLocationsLock sync.Mutex
+
+func liveLocationKey(message Message) string {
+	return fmt.Sprintf("%d:%d", message.Chat.ID, message.ID)
+}
+
+func liveLocationInterval() time.Duration {
+	if config.LiveLocationInterval > 0 {
+		return time.Duration(config.LiveLocationInterval) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// telegramLiveLocation relays a live location update to IRC unless another
+// update of the same live location has been relayed recently
+func telegramLiveLocation(message Message) {
+	key := liveLocationKey(message)
+	now := time.Now()
+	interval := liveLocationInterval()
+
+	liveLocationsLock.Lock()
+	last, ok := liveLocations[key]
+	if ok && now.Sub(last) < interval {
+		liveLocationsLock.Unlock()
+		return
+	}
+	liveLocations[key] = now
+	for other, last := range liveLocations {
+		// Live locations last for at most a day
+		if now.Sub(last) > 24*time.Hour {
+			delete(liveLocations, other)
+		}
+	}
+	liveLocationsLock.Unlock()
+
+	// Type>ID|Timestamp|Username|UID|Latitude|Longitude
+	logf("LIVELOCATION>%[1]d|%[2]d|%[3]s|%[4]d|%[5]f|%[6]f\n",
+		message.ID,
+		now.Unix(),
+		telegramUsername(message),
+		message.Sender.ID,
+		message.Location.Latitude,
+		message.Location.Longitude,
+	)
+	ircmessage(message.Chat.ID, telegramUsername(message), fmt.Sprintf("[live location update] %s", mapLink(message.Location)))
+}
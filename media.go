@@ -0,0 +1,323 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MediaStore stores media files so that they can be linked to on IRC
+type MediaStore interface {
+	// Upload stores the given file and returns a public URL to it
+	Upload(ctx context.Context, file io.ReadSeeker, size int64, mime string) (string, error)
+	// SupportsMime checks if the store can store files of the given type
+	SupportsMime(mime string) bool
+}
+
+// Media store names used in the config
+const (
+	StoreMIS   = "mis"
+	StoreLocal = "local"
+	StoreS3    = "s3"
+)
+
+var mediaStores = make(map[string]MediaStore)
+
+// extensions contains the preferred file extensions for common mime types
+var extensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"audio/ogg":       ".ogg",
+	"application/ogg": ".ogg",
+	"application/pdf": ".pdf",
+	"audio/mpeg":      ".mp3",
+	"text/vcard":      ".vcf",
+}
+
+func initMediaStores() {
+	if len(config.MIS.Address) > 0 {
+		mediaStores[StoreMIS] = &MISStore{}
+	}
+	if len(config.Local.Directory) > 0 {
+		err := os.MkdirAll(config.Local.Directory, 0755)
+		if err != nil {
+			panic(err)
+		}
+		mediaStores[StoreLocal] = &LocalStore{}
+		go startHTTP()
+	}
+	if len(config.S3.Endpoint) > 0 {
+		s3, err := NewS3Store()
+		if err != nil {
+			panic(err)
+		}
+		mediaStores[StoreS3] = s3
+	}
+}
+
+// GetMediaStore returns the name of the media store that should be used for the given IRC channel and the store itself
+func GetMediaStore(channel string) (string, MediaStore, bool) {
+	name := config.GetOptions(channel).MediaStore
+	if len(name) == 0 {
+		name = config.MediaStore
+	}
+	if len(name) == 0 {
+		name = StoreMIS
+	}
+	store, ok := mediaStores[name]
+	return name, store, ok
+}
+
+// fileHash returns the hex-encoded SHA-256 hash of the given file.
+// The file is rewound to the start afterwards.
+func fileHash(file io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	} else if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Naming schemes for the local media store
+const (
+	NamingRandom = "random"
+	NamingHash   = "hash"
+)
+
+const nameAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// RandomName generates a cryptographically random string matching [a-zA-Z0-9]{length}
+func RandomName(length int) string {
+	name := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(name) < length {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		for _, b := range buf {
+			// Discard values that would make some characters more likely than others
+			if idx := int(b & 63); idx < len(nameAlphabet) && len(name) < length {
+				name = append(name, nameAlphabet[idx])
+			}
+		}
+	}
+	return string(name)
+}
+
+// mediaName returns a file name based on the hash of the given file.
+// The file is rewound to the start afterwards.
+func mediaName(file io.ReadSeeker, mimeType string) (string, error) {
+	hash, err := fileHash(file)
+	if err != nil {
+		return "", err
+	}
+	return hash[:32] + mediaExtension(mimeType), nil
+}
+
+func mediaExtension(mimeType string) string {
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	if ext, ok := extensions[mimeType]; ok {
+		return ext
+	} else if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// inlineMime checks if files of the given type are safe to show in browsers from the origin they're served from.
+// Other types, like HTML and SVG, can contain scripts, so they're only served as downloads.
+func inlineMime(mimeType string) bool {
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp":
+		return true
+	}
+	return strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/")
+}
+
+// extensionType returns the mime type that the given extension is preferred for
+func extensionType(ext string) string {
+	for mimeType, preferred := range extensions {
+		if preferred == ext {
+			return mimeType
+		}
+	}
+	return ""
+}
+
+// LocalStore saves media files to a local directory that is served by the bridge's HTTP server
+type LocalStore struct{}
+
+// SupportsMime returns true, as the local store can store any files
+func (store *LocalStore) SupportsMime(mime string) bool {
+	return true
+}
+
+// Upload copies the given file to the media directory
+func (store *LocalStore) Upload(ctx context.Context, file io.ReadSeeker, size int64, mime string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var name string
+	if config.Local.Naming == NamingHash {
+		var err error
+		name, err = mediaName(file, mime)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		name = RandomName(24) + mediaExtension(mime)
+	}
+
+	path := filepath.Join(config.Local.Directory, name)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, file)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	// Reuploading content with a hashed name should reset the expiry
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(config.HTTP.PublicURL, "/"), name), nil
+}
+
+// mediaExpiry returns how long files stay available in the given media store. 0 means forever.
+// MIS never removes images and S3 objects are only removed by lifecycle rules of the bucket,
+// so their expiry has to be configured to match.
+func mediaExpiry(storeName string) time.Duration {
+	switch storeName {
+	case StoreLocal:
+		return time.Duration(config.Local.Expiry) * time.Hour
+	case StoreS3:
+		return time.Duration(config.S3.Expiry) * time.Hour
+	}
+	return 0
+}
+
+// expired checks whether a file saved at the given time has expired
+func expired(modified time.Time) bool {
+	return config.Local.Expiry > 0 && time.Since(modified) > time.Duration(config.Local.Expiry)*time.Hour
+}
+
+func startHTTP() {
+	http.Handle("/", http.HandlerFunc(serveMedia))
+	go cleanupLoop()
+
+	logf("[DEBUG] Serving media on %s\n", config.HTTP.Address)
+	err := http.ListenAndServe(config.HTTP.Address, nil)
+	if err != nil {
+		logf("[DEBUG] Media HTTP server stopped: %s\n", err)
+	}
+}
+
+func serveMedia(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	// Only serve plain file names so that nothing outside the media directory can be accessed
+	// and the contents of the directory can't be listed.
+	if len(name) == 0 || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(config.Local.Directory, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() || expired(stat.ModTime()) {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if len(contentType) == 0 {
+		contentType = extensionType(filepath.Ext(name))
+	}
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	if !inlineMime(contentType) {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, stat.ModTime(), file)
+}
+
+func cleanupLoop() {
+	if config.Local.Expiry <= 0 {
+		return
+	}
+	for {
+		cleanupMedia()
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+// cleanupMedia removes expired files from the media directory
+func cleanupMedia() {
+	files, err := ioutil.ReadDir(config.Local.Directory)
+	if err != nil {
+		logf("[DEBUG] Failed to read media directory: %s\n", err)
+		return
+	}
+
+	var removed int
+	for _, file := range files {
+		if file.IsDir() || !expired(file.ModTime()) {
+			continue
+		}
+		err = os.Remove(filepath.Join(config.Local.Directory, file.Name()))
+		if err != nil {
+			logf("[DEBUG] Failed to remove expired media file %s: %s\n", file.Name(), err)
+		} else {
+			removed++
+		}
+	}
+	if removed > 0 {
+		logf("[DEBUG] Removed %d expired media files\n", removed)
+	}
+}
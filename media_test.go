@@ -0,0 +1,66 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeMediaHeaders(t *testing.T) {
+	config = &Config{}
+	config.Local.Directory = t.TempDir()
+	defer func() { config = nil }()
+
+	tests := []struct {
+		name        string
+		contentType string
+		attachment  bool
+	}{
+		{"a.jpg", "image/jpeg", false},
+		{"a.png", "image/png", false},
+		{"a.webp", "image/webp", false},
+		{"a.mp4", "", false},
+		{"a.ogg", "", false},
+		{"a.htm", "text/html; charset=utf-8", true},
+		{"a.svg", "image/svg+xml", true},
+		{"a.xml", "text/xml; charset=utf-8", true},
+		{"a.pdf", "application/pdf", true},
+		{"a.bin", "application/octet-stream", true},
+	}
+	for _, test := range tests {
+		err := ioutil.WriteFile(filepath.Join(config.Local.Directory, test.name), []byte("<script>alert(1)</script>"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		serveMedia(w, httptest.NewRequest("GET", "/"+test.name, nil))
+
+		header := w.Result().Header
+		// The types of some extensions depend on the system's mime tables
+		if contentType := header.Get("Content-Type"); len(test.contentType) > 0 && contentType != test.contentType {
+			t.Errorf("%s: got content type %q, expected %q", test.name, contentType, test.contentType)
+		}
+		if attachment := header.Get("Content-Disposition") == "attachment"; attachment != test.attachment {
+			t.Errorf("%s: got attachment %t, expected %t", test.name, attachment, test.attachment)
+		}
+		if csp := header.Get("Content-Security-Policy"); csp != "sandbox" {
+			t.Errorf("%s: got CSP %q, expected sandbox", test.name, csp)
+		}
+	}
+}
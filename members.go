@@ -0,0 +1,125 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	goirc "github.com/thoj/go-ircevent"
+)
+
+// members contains the nicks of the users in each IRC channel the bridge is in.
+// Both the channel names and nicks are lowercase.
+var members = make(map[string]map[string]bool)
+var membersLock sync.RWMutex
+
+// trackMembers adds the IRC callbacks that keep the member lists up to date
+func trackMembers() {
+	// NAMES reply: <me> <symbol> <channel> :<nicks>
+	irc.AddCallback("353", func(event *goirc.Event) {
+		if len(event.Arguments) < 4 {
+			return
+		}
+		membersLock.Lock()
+		defer membersLock.Unlock()
+		channel := channelMembers(event.Arguments[2])
+		for _, nick := range strings.Fields(event.Arguments[3]) {
+			channel[strings.ToLower(strings.TrimLeft(nick, "~&@%+"))] = true
+		}
+	})
+
+	irc.AddCallback("JOIN", func(event *goirc.Event) {
+		membersLock.Lock()
+		defer membersLock.Unlock()
+		channel := strings.ToLower(event.Arguments[0])
+		if strings.EqualFold(event.Nick, irc.GetNick()) {
+			// The list will be filled by the NAMES reply
+			members[channel] = make(map[string]bool)
+		}
+		channelMembers(channel)[strings.ToLower(event.Nick)] = true
+	})
+
+	irc.AddCallback("PART", func(event *goirc.Event) {
+		removeMember(event.Arguments[0], event.Nick)
+	})
+
+	irc.AddCallback("KICK", func(event *goirc.Event) {
+		if len(event.Arguments) > 1 {
+			removeMember(event.Arguments[0], event.Arguments[1])
+		}
+	})
+
+	irc.AddCallback("QUIT", func(event *goirc.Event) {
+		membersLock.Lock()
+		defer membersLock.Unlock()
+		nick := strings.ToLower(event.Nick)
+		for _, channel := range members {
+			delete(channel, nick)
+		}
+	})
+
+	irc.AddCallback("NICK", func(event *goirc.Event) {
+		membersLock.Lock()
+		defer membersLock.Unlock()
+		oldNick, newNick := strings.ToLower(event.Nick), strings.ToLower(event.Message())
+		for _, channel := range members {
+			if channel[oldNick] {
+				delete(channel, oldNick)
+				channel[newNick] = true
+			}
+		}
+	})
+}
+
+// channelMembers returns the member list of the given channel. The caller must hold the write lock.
+func channelMembers(channel string) map[string]bool {
+	channel = strings.ToLower(channel)
+	list, ok := members[channel]
+	if !ok {
+		list = make(map[string]bool)
+		members[channel] = list
+	}
+	return list
+}
+
+func removeMember(channel, nick string) {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+	channel = strings.ToLower(channel)
+	if strings.EqualFold(nick, irc.GetNick()) {
+		delete(members, channel)
+	} else if list, ok := members[channel]; ok {
+		delete(list, strings.ToLower(nick))
+	}
+}
+
+// mappedChannelsOf returns the bridged IRC channels the given user is in
+func mappedChannelsOf(nick string) []string {
+	membersLock.RLock()
+	defer membersLock.RUnlock()
+	nick = strings.ToLower(nick)
+
+	var channels []string
+	for _, channel := range config.IRCChannels() {
+		if members[strings.ToLower(channel)][nick] {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
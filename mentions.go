@@ -0,0 +1,138 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// nickPattern matches words that may be IRC nicks or Telegram names
+var nickPattern = regexp.MustCompile("^[\\p{L}\\p{N}_\\-\\[\\]\\\\^{}|`\u200B]+$")
+
+// wordPattern matches the whitespace-delimited words of a message
+var wordPattern = regexp.MustCompile("\\S+")
+
+// trailingPunctuation is removed from the end of words before looking them up as names
+const trailingPunctuation = ".,:;!?"
+
+var linkTextReplacer = strings.NewReplacer("[", "", "]", "", "*", "", "_", "", "`", "")
+
+// telegramMentions returns the text of the given message with Telegram mentions replaced with IRC names
+func telegramMentions(message Message) string {
+	return translateMentions(message.Text, message.Entities)
+}
+
+// telegramCaption returns the caption of the given message with Telegram mentions replaced with IRC names
+func telegramCaption(message Message) string {
+	return translateMentions(message.Caption, message.CaptionEntities)
+}
+
+func translateMentions(input string, entities []MessageEntity) string {
+	if len(entities) == 0 {
+		return input
+	}
+
+	// Entity offsets and lengths are in UTF-16 code units
+	text := utf16.Encode([]rune(input))
+	var buf bytes.Buffer
+	var last int
+	for _, entity := range entities {
+		end := entity.Offset + entity.Length
+		if entity.Offset < last || end > len(text) {
+			continue
+		}
+
+		var name string
+		if entity.Type == "mention" {
+			name = string(utf16.Decode(text[entity.Offset+1 : end]))
+		} else if entity.Type == "text_mention" && entity.User != nil {
+			name = telegramName(*entity.User)
+		} else {
+			continue
+		}
+
+		buf.WriteString(string(utf16.Decode(text[last:entity.Offset])))
+		buf.WriteString(name)
+		last = end
+	}
+	buf.WriteString(string(utf16.Decode(text[last:])))
+	return buf.String()
+}
+
+// ircMentions converts an IRC message to Telegram Markdown and turns mentions of known Telegram users into Telegram mentions.
+// Explicit @name mentions and the nick: or nick, prefix addressing someone can refer to any name the bridge knows,
+// but other words are only mentions if they're the Telegram username of someone, as first names are often common words.
+func ircMentions(chat int64, message string) string {
+	channel, _ := config.GetIRCChannel(strconv.FormatInt(chat, 10))
+	var buf bytes.Buffer
+	var last int
+	for i, loc := range wordPattern.FindAllStringIndex(message, -1) {
+		word := message[loc[0]:loc[1]]
+		if strings.Contains(word, "://") || strings.HasPrefix(strings.ToLower(word), "www.") {
+			continue
+		}
+		name := strings.TrimRight(word, trailingPunctuation)
+		end := loc[0] + len(name)
+		explicit := strings.HasPrefix(name, "@")
+		if explicit {
+			name = name[1:]
+		} else if i == 0 && end < loc[1] && (message[end] == ':' || message[end] == ',') {
+			explicit = true
+		}
+		if !nickPattern.MatchString(name) {
+			continue
+		}
+
+		user, ok := mentionedUser(chat, channel, name, !explicit)
+		if !ok {
+			continue
+		}
+		buf.WriteString(decodeIRC(message[last:loc[0]]))
+		buf.WriteString(telegramMention(user))
+		last = end
+	}
+	buf.WriteString(decodeIRC(message[last:]))
+	return buf.String()
+}
+
+// mentionedUser finds the Telegram user a nick written on IRC refers to.
+// If usernameOnly is true, the nick must be the Telegram username of the user.
+func mentionedUser(chat int64, channel, nick string, usernameOnly bool) (User, bool) {
+	for _, name := range nickCandidates(channel, nick) {
+		if user, ok := TelegramUserByName(chat, name); ok && (!usernameOnly || strings.EqualFold(user.Username, name)) {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// telegramMention returns a Markdown mention of the given Telegram user
+func telegramMention(user User) string {
+	if len(user.Username) > 0 {
+		return "@" + decodeIRC(user.Username)
+	}
+
+	name := linkTextReplacer.Replace(telegramName(user))
+	if len(strings.TrimSpace(name)) == 0 {
+		name = strconv.Itoa(user.ID)
+	}
+	return fmt.Sprintf("[%s](tg://user?id=%d)", name, user.ID)
+}
@@ -0,0 +1,85 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import "testing"
+
+func TestTranslateMentions(t *testing.T) {
+	max := &User{ID: 5, FirstName: "Max"}
+	tests := []struct {
+		name     string
+		text     string
+		entities []MessageEntity
+		expected string
+	}{
+		{"no entities", "hi @bob", nil, "hi @bob"},
+		{"mention", "hi @bob!", []MessageEntity{{Type: "mention", Offset: 3, Length: 4}}, "hi bob!"},
+		{"text mention", "hi Max", []MessageEntity{{Type: "text_mention", Offset: 3, Length: 3, User: max}}, "hi Max"},
+		{"text mention with username", "hi Bob", []MessageEntity{{Type: "text_mention", Offset: 3, Length: 3, User: &User{ID: 1, FirstName: "Bob", Username: "bobby"}}}, "hi bobby"},
+		{"other entities", "hi **bob**", []MessageEntity{{Type: "bold", Offset: 3, Length: 7}}, "hi **bob**"},
+		// 😀 is two UTF-16 code units
+		{"emoji before mention", "😀 @bob 😀 @max", []MessageEntity{
+			{Type: "mention", Offset: 3, Length: 4},
+			{Type: "mention", Offset: 11, Length: 4},
+		}, "😀 bob 😀 max"},
+		{"emoji in text mention", "hi 😀Max", []MessageEntity{{Type: "text_mention", Offset: 3, Length: 5, User: max}}, "hi Max"},
+		{"overlapping entities", "@bob", []MessageEntity{
+			{Type: "mention", Offset: 0, Length: 4},
+			{Type: "mention", Offset: 1, Length: 3},
+		}, "bob"},
+		{"out of range", "@bob", []MessageEntity{{Type: "mention", Offset: 2, Length: 4}}, "@bob"},
+	}
+	for _, test := range tests {
+		if result := translateMentions(test.text, test.entities); result != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestIRCMentions(t *testing.T) {
+	openTestStore(t)
+	defer closeTestStore()
+	config = &Config{Mappings: map[string]string{"#chan": "-1"}}
+	defer func() { config = nil }()
+	StoreTelegramUser(-1, User{ID: 1, FirstName: "Bob", Username: "bob"})
+	StoreTelegramUser(-1, User{ID: 5, FirstName: "Max"})
+
+	const maxMention = "[Max](tg://user?id=5)"
+	tests := []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{"urls and first names", "see https://github.com/bob/repo and max value", "see https://github.com/bob/repo and max value"},
+		{"www link", "www.bob.com", "www.bob.com"},
+		{"email", "mail bob@example.com", "mail bob@example.com"},
+		{"username", "hi bob.", "hi @bob."},
+		{"username case", "hi BOB", "hi @bob"},
+		{"addressing username", "b\u200bob: hi", "@bob: hi"},
+		{"addressing first name", "max: hi", maxMention + ": hi"},
+		{"addressing with comma", "max, hi", maxMention + ", hi"},
+		{"addressing mid-line", "hey max: hi", "hey max: hi"},
+		{"explicit first name", "hi @max!", "hi " + maxMention + "!"},
+		{"explicit unknown", "hi @nobody", "hi @nobody"},
+		{"protected nick", "b\u200bob: hi", "@bob: hi"},
+		{"markdown", "hi *bob*", "hi \\*bob\\*"},
+	}
+	for _, test := range tests {
+		if result := ircMentions(-1, test.message); result != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Nick protection modes
+const (
+	ProtectZWSP       = "zwsp"
+	ProtectSubstitute = "substitute"
+)
+
+const zwsp = "\u200b"
+
+// homoglyphs maps latin letters to look-alike cyrillic letters
+var homoglyphs = map[rune]rune{
+	'a': 'а', 'c': 'с', 'e': 'е', 'i': 'і', 'o': 'о', 'p': 'р', 'x': 'х', 'y': 'у',
+	'A': 'А', 'B': 'В', 'C': 'С', 'E': 'Е', 'H': 'Н', 'K': 'К', 'M': 'М',
+	'O': 'О', 'P': 'Р', 'T': 'Т', 'X': 'Х',
+}
+
+var reverseHomoglyphs = make(map[rune]rune)
+
+func init() {
+	for latin, cyrillic := range homoglyphs {
+		reverseHomoglyphs[cyrillic] = latin
+	}
+}
+
+// nickColors contains the mIRC colours used for relayed names.
+// White, black and the greys are left out as they're unreadable on some backgrounds.
+var nickColors = []int{2, 3, 4, 5, 6, 7, 9, 10, 11, 12, 13}
+
+// formatNick formats a relayed Telegram name for the given IRC channel
+func formatNick(channel, name string) string {
+	options := config.GetOptions(channel)
+	switch options.NickProtection {
+	case ProtectZWSP:
+		name = protectZWSP(name)
+	case ProtectSubstitute:
+		name = protectSubstitute(name)
+	}
+	if options.NickColors {
+		name = colorNick(name)
+	}
+	return name
+}
+
+// protectZWSP inserts a zero-width space after the first character of the name
+func protectZWSP(name string) string {
+	_, size := utf8.DecodeRuneInString(name)
+	if size == 0 || size == len(name) {
+		return name
+	}
+	return name[:size] + zwsp + name[size:]
+}
+
+// protectSubstitute replaces the first latin letter that has a look-alike with the look-alike.
+// Names with no such letters are protected with a zero-width space instead.
+func protectSubstitute(name string) string {
+	for i, char := range name {
+		if glyph, ok := homoglyphs[char]; ok {
+			return name[:i] + string(glyph) + name[i+utf8.RuneLen(char):]
+		}
+	}
+	return protectZWSP(name)
+}
+
+// nickCandidates returns the names a nick written on IRC may refer to, most likely first. The nick
+// itself is always tried first, as real names may contain zero-width spaces or cyrillic letters.
+// Homoglyphs are only reversed in channels that use the substitute protection mode.
+func nickCandidates(channel, nick string) []string {
+	candidates := []string{nick}
+	stripped := strings.Replace(nick, zwsp, "", -1)
+	if stripped != nick {
+		candidates = append(candidates, stripped)
+	}
+	if config.GetOptions(channel).NickProtection == ProtectSubstitute {
+		if original := unsubstitute(stripped); original != stripped {
+			candidates = append(candidates, original)
+		}
+	}
+	return candidates
+}
+
+// unsubstitute reverses protectSubstitute by replacing the first look-alike letter with the latin letter
+func unsubstitute(name string) string {
+	for i, char := range name {
+		if latin, ok := reverseHomoglyphs[char]; ok {
+			return name[:i] + string(latin) + name[i+utf8.RuneLen(char):]
+		}
+	}
+	return name
+}
+
+// colorNick wraps the name in a mIRC colour code chosen deterministically from the name
+func colorNick(name string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("\x03%02d%s\x03", nickColors[hash.Sum32()%uint32(len(nickColors))], name)
+}
@@ -0,0 +1,304 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VoteCommand is the IRC command used to vote in bridged polls
+const VoteCommand = "!vote"
+
+// ClosePollCommand is the Telegram command the sender of a poll or an admin can reply to the poll with to close it
+const ClosePollCommand = "/closepoll"
+
+// BridgedPoll is a Telegram poll that has been relayed to IRC.
+// The Bot API only sends vote updates for polls the bot sent itself, so the bridge posts a copy of each poll
+// as a reply to the original. Votes on the copy are counted, votes on the original can't be seen by the bridge.
+// The only update about the original is it being stopped, which stops the copy as well.
+// The Bot API doesn't allow bots to vote on behalf of others either, so votes from IRC are counted by the bridge
+// and added to the Telegram results when the copy is closed.
+type BridgedPoll struct {
+	Number int `json:"number"`
+	// The latest state of the bridge's copy of the poll
+	Poll       Poll  `json:"poll"`
+	Chat       int64 `json:"chat"`
+	MessageID  int   `json:"message-id"`
+	OriginalID int   `json:"original-id"`
+	// The ID of the original poll
+	OriginalPollID string `json:"original-poll-id"`
+	Sender         int    `json:"sender"`
+	Channel        string `json:"channel"`
+	// Votes from IRC by nick
+	Votes   map[string][]int `json:"votes"`
+	Created int64            `json:"created"`
+}
+
+// pollKind returns the name of the type of the poll
+func pollKind(poll Poll) string {
+	if poll.Type == "quiz" {
+		return "quiz"
+	}
+	return "poll"
+}
+
+// telegramPoll relays a poll sent to Telegram to IRC and posts the copy of the poll that votes are counted on
+func telegramPoll(message Message) {
+	chat := strconv.FormatInt(message.Chat.ID, 10)
+	channel, ok := config.GetIRCChannel(chat)
+	if !ok {
+		logf("Unidentified Telegram group: %d\n", message.Chat.ID)
+		return
+	}
+
+	var poll *BridgedPoll
+	if !message.Poll.IsClosed && store != nil {
+		sent, err := SendTelegramPoll(chat, message.Poll, message.ID)
+		if err != nil {
+			logf("[DEBUG] Failed to send copy of poll to Telegram: %s\n", err)
+		} else {
+			poll = &BridgedPoll{
+				Poll:           sent.Poll,
+				Chat:           message.Chat.ID,
+				MessageID:      sent.ID,
+				OriginalID:     message.ID,
+				OriginalPollID: message.Poll.ID,
+				Sender:         message.Sender.ID,
+				Channel:        channel,
+				Votes:          make(map[string][]int),
+			}
+			if err = StorePoll(poll); err != nil {
+				logf("[DEBUG] Failed to store poll: %s\n", err)
+				poll = nil
+			}
+		}
+	}
+
+	options := make([]string, len(message.Poll.Options))
+	header := fmt.Sprintf("[%s] %s", pollKind(message.Poll), message.Poll.Question)
+	if poll != nil {
+		header = fmt.Sprintf("[%s #%d] %s", pollKind(message.Poll), poll.Number, message.Poll.Question)
+	}
+	lines := []string{header}
+	for i, option := range message.Poll.Options {
+		options[i] = option.Text
+		lines = append(lines, fmt.Sprintf("%d) %s", i+1, option.Text))
+	}
+	if poll != nil {
+		lines = append(lines, fmt.Sprintf("Vote with %s #%d <option>", VoteCommand, poll.Number))
+	}
+
+	// Type>ID|Timestamp|Username|UID|Question||Options
+	logf("POLL>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s§%[6]s\n",
+		message.ID,
+		message.Time().Unix(),
+		telegramUsername(message),
+		message.Sender.ID,
+		message.Poll.Question,
+		strings.Join(options, "|"),
+	)
+	relay(message, telegramUsername(message), ircPrefix(message)+strings.Join(lines, "\n"))
+}
+
+// telegramClosePoll closes the poll the sender of the poll or an admin replied to with the close poll command
+func telegramClosePoll(message Message) {
+	if message.ReplyTo == nil {
+		commandError(message, ClosePollCommand, "Reply to the poll you want to close with "+ClosePollCommand)
+		return
+	}
+	poll, ok := PollByMessage(message.Chat.ID, message.ReplyTo.ID)
+	if !ok {
+		commandError(message, ClosePollCommand, "That isn't an open poll")
+		return
+	}
+	if message.Sender.ID != poll.Sender {
+		admin, err := IsTelegramAdmin(message.Chat.ID, message.Sender.ID)
+		if err != nil {
+			logf("[DEBUG] Failed to check admin status of %d: %s\n", message.Sender.ID, err)
+			commandError(message, ClosePollCommand, "Couldn't check if you're an admin")
+			return
+		} else if !admin {
+			commandError(message, ClosePollCommand, "Only the sender of the poll and admins can close it")
+			return
+		}
+	}
+
+	if !stopCopy(poll, false) {
+		commandError(message, ClosePollCommand, "Couldn't close the poll")
+	}
+}
+
+// stopCopy closes the bridge's copy of a poll and posts the results to IRC. If the copy can't be stopped,
+// for example because it was deleted, false is returned and the poll stays open unless force is true,
+// in which case the last known results are posted.
+func stopCopy(poll *BridgedPoll, force bool) bool {
+	update, err := StopTelegramPoll(poll.Chat, poll.MessageID)
+	if err != nil {
+		logf("[DEBUG] Failed to stop poll %s: %s\n", poll.Poll.ID, err)
+		if !force {
+			return false
+		}
+		update = poll.Poll
+		update.IsClosed = true
+	}
+	pollUpdate(update)
+	return err == nil
+}
+
+// pollUpdate handles a new state of a poll sent by the bridge and posts the results to IRC when the poll is closed.
+// If the original of a bridged poll is stopped, the bridge's copy is stopped too.
+func pollUpdate(update Poll) {
+	if bridged, ok := PollByOriginal(update.ID); ok {
+		if update.IsClosed {
+			stopCopy(bridged, true)
+		}
+		return
+	} else if !update.IsClosed {
+		_, _, err := UpdatePoll(update.ID, func(poll *BridgedPoll) error {
+			poll.Poll = update
+			return nil
+		})
+		if err != nil {
+			logf("[DEBUG] Failed to update poll: %s\n", err)
+		}
+		return
+	}
+	// Closing the poll with the command and the update about it from Telegram both end up here,
+	// but only the first one finds the poll in the store
+	poll, ok := RemovePoll(update.ID)
+	if !ok {
+		return
+	}
+
+	ircVotes := make([]int, len(update.Options))
+	for _, options := range poll.Votes {
+		for _, option := range options {
+			if option < len(ircVotes) {
+				ircVotes[option]++
+			}
+		}
+	}
+
+	lines := []string{fmt.Sprintf("[%s #%d closed] %s", pollKind(update), poll.Number, update.Question)}
+	counts := make([]string, len(update.Options))
+	for i, option := range update.Options {
+		line := fmt.Sprintf("%d) %s: %d", i+1, option.Text, option.VoterCount+ircVotes[i])
+		if ircVotes[i] > 0 {
+			line = fmt.Sprintf("%s (%d from IRC)", line, ircVotes[i])
+		}
+		if update.CorrectOptionID != nil && *update.CorrectOptionID == i {
+			line += " ✓"
+		}
+		lines = append(lines, line)
+		counts[i] = fmt.Sprintf("%d+%d", option.VoterCount, ircVotes[i])
+	}
+
+	// Type>ID|Timestamp|Question||TelegramVotes+IRCVotes
+	logf("POLLRESULT>%[1]d|%[2]d|%[3]s§%[4]s\n",
+		poll.OriginalID,
+		time.Now().Unix(),
+		update.Question,
+		strings.Join(counts, "|"),
+	)
+	for _, line := range lines {
+		irc.Privmsg(poll.Channel, line)
+	}
+}
+
+// ircVote handles vote commands sent on IRC. It returns false if the message isn't a vote command.
+func ircVote(channel, nick, message string) bool {
+	args := strings.Fields(message)
+	if len(args) == 0 || !strings.EqualFold(args[0], VoteCommand) {
+		return false
+	}
+	args = args[1:]
+
+	var number int
+	if len(args) > 0 && strings.HasPrefix(args[0], "#") {
+		number, _ = strconv.Atoi(args[0][1:])
+		if number <= 0 {
+			irc.Notice(nick, "There is no open poll with that number in "+channel)
+			return true
+		}
+		args = args[1:]
+	}
+	found, ok := PollByNumber(channel, number)
+	if !ok || !strings.EqualFold(found.Channel, channel) {
+		irc.Notice(nick, "There is no open poll with that number in "+channel)
+		return true
+	}
+
+	var names []string
+	poll, ok, err := UpdatePoll(found.Poll.ID, func(poll *BridgedPoll) error {
+		options, err := parseVote(poll.Poll, args)
+		if err != nil {
+			return err
+		} else if _, voted := poll.Votes[nick]; voted && poll.Poll.Type == "quiz" {
+			return fmt.Errorf("You have already answered this quiz")
+		}
+		if poll.Votes == nil {
+			poll.Votes = make(map[string][]int)
+		}
+		poll.Votes[nick] = options
+		names = make([]string, len(options))
+		for i, option := range options {
+			names[i] = poll.Poll.Options[option].Text
+		}
+		return nil
+	})
+	if err != nil {
+		irc.Notice(nick, err.Error())
+		return true
+	} else if !ok {
+		irc.Notice(nick, "There is no open poll with that number in "+channel)
+		return true
+	}
+
+	// Type>Timestamp|Nick|PollID|Options
+	logf("IRCVOTE>%[1]d|%[2]s|%[3]s|%[4]s\n", time.Now().Unix(), nick, poll.Poll.ID, strings.Join(names, "|"))
+	text := fmt.Sprintf("*<%s>* voted for %s", nick, decodeIRC(strings.Join(names, ", ")))
+	if _, err := SendTelegramMessage(strconv.FormatInt(poll.Chat, 10), text, poll.MessageID); err != nil {
+		logf("[DEBUG] Failed to send vote to Telegram: %s\n", err)
+	}
+	return true
+}
+
+// parseVote parses the option numbers of a vote command into option indexes
+func parseVote(poll Poll, args []string) ([]int, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Usage: %s [#poll] <option>", VoteCommand)
+	} else if len(args) > 1 && !poll.AllowsMultipleAnswers {
+		return nil, fmt.Errorf("This %s only allows one answer", pollKind(poll))
+	}
+
+	seen := make(map[int]bool)
+	var options []int
+	for _, arg := range args {
+		option, err := strconv.Atoi(arg)
+		if err != nil || option < 1 || option > len(poll.Options) {
+			return nil, fmt.Errorf("Invalid option %q: choose a number between 1 and %d", arg, len(poll.Options))
+		} else if !seen[option-1] {
+			seen[option-1] = true
+			options = append(options, option-1)
+		}
+	}
+	sort.Ints(options)
+	return options, nil
+}
@@ -0,0 +1,78 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Store uploads media files to S3-compatible object storage, e.g. AWS S3 or MinIO
+type S3Store struct {
+	client    *minio.Client
+	publicURL string
+}
+
+// NewS3Store creates a S3 media store from the config
+func NewS3Store() (*S3Store, error) {
+	client, err := minio.New(config.S3.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.S3.AccessKey, config.S3.SecretKey, ""),
+		Secure: config.S3.TLS,
+		Region: config.S3.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	publicURL := config.S3.PublicURL
+	if len(publicURL) == 0 {
+		scheme := "http"
+		if config.S3.TLS {
+			scheme = "https"
+		}
+		publicURL = fmt.Sprintf("%s://%s/%s", scheme, config.S3.Endpoint, config.S3.Bucket)
+	}
+	return &S3Store{client: client, publicURL: strings.TrimSuffix(publicURL, "/")}, nil
+}
+
+// SupportsMime returns true, as S3 can store any files
+func (store *S3Store) SupportsMime(mime string) bool {
+	return true
+}
+
+// Upload uploads the given file to the configured bucket
+func (store *S3Store) Upload(ctx context.Context, file io.ReadSeeker, size int64, mime string) (string, error) {
+	name, err := mediaName(file, mime)
+	if err != nil {
+		return "", err
+	}
+	options := minio.PutObjectOptions{ContentType: mime}
+	// The bucket can't send a sandboxing CSP, so files that could run scripts are only served as downloads
+	if !inlineMime(mime) {
+		options.ContentType = "application/octet-stream"
+		options.ContentDisposition = "attachment"
+	}
+	_, err = store.client.PutObject(ctx, config.S3.Bucket, name, file, size, options)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", store.publicURL, name), nil
+}
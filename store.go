@@ -0,0 +1,810 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket names in the message store
+var (
+	bucketTelegram = []byte("telegram")
+	bucketIRC      = []byte("irc")
+	bucketHash     = []byte("hash")
+	bucketLatest   = []byte("latest")
+	bucketUsers    = []byte("users")
+	bucketMedia    = []byte("media")
+	bucketPolls    = []byte("polls")
+	bucketPollNums = []byte("poll-numbers")
+	bucketPollLast = []byte("latest-polls")
+	bucketPollOrig = []byte("poll-originals")
+)
+
+var storeBuckets = [][]byte{bucketTelegram, bucketIRC, bucketHash, bucketLatest, bucketUsers, bucketMedia, bucketPolls, bucketPollNums, bucketPollLast, bucketPollOrig}
+
+// MessageMapping links a Telegram message to the matching message on IRC
+type MessageMapping struct {
+	TelegramChat int64  `json:"telegram-chat"`
+	TelegramID   int    `json:"telegram-id"`
+	IRCChannel   string `json:"irc-channel"`
+	IRCMsgID     string `json:"irc-msgid,omitempty"`
+	IRCNick      string `json:"irc-nick"`
+	IRCTime      int64  `json:"irc-time"`
+	FromIRC      bool   `json:"from-irc"`
+	Created      int64  `json:"created"`
+	// Hashes of the lines the message was sent to IRC as, which identify the lines when the server echoes them back
+	LineHashes []string `json:"line-hashes,omitempty"`
+}
+
+func (mapping *MessageMapping) telegramKey() []byte {
+	return telegramKey(mapping.TelegramChat, mapping.TelegramID)
+}
+
+func (mapping *MessageMapping) ircKey() []byte {
+	if len(mapping.IRCMsgID) == 0 {
+		return nil
+	}
+	return ircKey(mapping.IRCChannel, mapping.IRCMsgID)
+}
+
+func (mapping *MessageMapping) hashKeys() [][]byte {
+	keys := make([][]byte, len(mapping.LineHashes))
+	for i, hash := range mapping.LineHashes {
+		keys[i] = hashKey(mapping.IRCChannel, hash)
+	}
+	return keys
+}
+
+func (mapping *MessageMapping) latestKey() []byte {
+	return latestKey(mapping.IRCChannel, mapping.IRCNick)
+}
+
+func telegramKey(chat int64, id int) []byte {
+	return []byte(fmt.Sprintf("%d:%d", chat, id))
+}
+
+func ircKey(channel, msgid string) []byte {
+	return []byte(channel + "\x00" + msgid)
+}
+
+func latestKey(channel, nick string) []byte {
+	return []byte(strings.ToLower(channel + "\x00" + nick))
+}
+
+func userKey(chat int64, name string) []byte {
+	return []byte(fmt.Sprintf("%d\x00%s", chat, strings.ToLower(name)))
+}
+
+func pollNumberKey(number int) []byte {
+	return []byte(strconv.Itoa(number))
+}
+
+func latestPollKey(channel string) []byte {
+	return []byte(strings.ToLower(channel))
+}
+
+func hashKey(channel, hash string) []byte {
+	return []byte(channel + "\x00" + hash)
+}
+
+// TextHash returns the hash used to correlate message texts across networks
+func TextHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:16])
+}
+
+var store *bolt.DB
+
+func openStore() {
+	dbPath := config.Store.Path
+	if len(dbPath) == 0 {
+		dbPath = "messages.db"
+	}
+
+	var err error
+	store, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		panic(err)
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		for _, name := range storeBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	go pruneLoop()
+}
+
+func closeStore() {
+	if store != nil {
+		store.Close()
+	}
+}
+
+// StoreMapping saves the given message mapping
+func StoreMapping(mapping *MessageMapping) {
+	if store == nil {
+		return
+	}
+	if mapping.Created == 0 {
+		mapping.Created = time.Now().Unix()
+	}
+
+	data, err := json.Marshal(mapping)
+	if err != nil {
+		logf("[DEBUG] Failed to encode message mapping: %s\n", err)
+		return
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		key := mapping.telegramKey()
+		if err := tx.Bucket(bucketTelegram).Put(key, data); err != nil {
+			return err
+		}
+		if ik := mapping.ircKey(); ik != nil {
+			if err := tx.Bucket(bucketIRC).Put(ik, key); err != nil {
+				return err
+			}
+		}
+		if !mapping.FromIRC {
+			if err := tx.Bucket(bucketLatest).Put(mapping.latestKey(), key); err != nil {
+				return err
+			}
+		}
+		for _, hk := range mapping.hashKeys() {
+			if err := tx.Bucket(bucketHash).Put(hk, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logf("[DEBUG] Failed to store message mapping: %s\n", err)
+	}
+}
+
+// MappingByTelegram finds the mapping for the given Telegram message
+func MappingByTelegram(chat int64, id int) (*MessageMapping, bool) {
+	return getMapping(func(tx *bolt.Tx) []byte {
+		return telegramKey(chat, id)
+	})
+}
+
+// MappingByIRC finds the mapping for the given IRCv3 message ID
+func MappingByIRC(channel, msgid string) (*MessageMapping, bool) {
+	return getMapping(func(tx *bolt.Tx) []byte {
+		return tx.Bucket(bucketIRC).Get(ircKey(channel, msgid))
+	})
+}
+
+// LatestByNick finds the most recent Telegram message relayed to the given channel with the given name
+func LatestByNick(channel, nick string) (*MessageMapping, bool) {
+	return getMapping(func(tx *bolt.Tx) []byte {
+		return tx.Bucket(bucketLatest).Get(latestKey(channel, nick))
+	})
+}
+
+// MappingByLine finds the mapping for a message that was sent to IRC as the given line
+func MappingByLine(channel, line string) (*MessageMapping, bool) {
+	return getMapping(func(tx *bolt.Tx) []byte {
+		return tx.Bucket(bucketHash).Get(hashKey(channel, TextHash(line)))
+	})
+}
+
+// StoreIRCMsgID saves the IRCv3 message ID of a line the bridge sent to IRC, so that IRC replies to the line can be
+// mapped to the Telegram message it came from. The first line's ID is saved in the mapping as well.
+func StoreIRCMsgID(channel, line, msgid string) (*MessageMapping, bool) {
+	if store == nil || len(msgid) == 0 {
+		return nil, false
+	}
+
+	var mapping *MessageMapping
+	err := store.Update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketHash).Get(hashKey(channel, TextHash(line)))
+		if key == nil {
+			return nil
+		}
+		key = append([]byte{}, key...)
+		data := tx.Bucket(bucketTelegram).Get(key)
+		if data == nil {
+			return nil
+		}
+		mapping = &MessageMapping{}
+		if err := json.Unmarshal(data, mapping); err != nil {
+			mapping = nil
+			return nil
+		}
+
+		if err := tx.Bucket(bucketIRC).Put(ircKey(channel, msgid), key); err != nil {
+			return err
+		} else if len(mapping.IRCMsgID) > 0 {
+			return nil
+		}
+		mapping.IRCMsgID = msgid
+		data, err := json.Marshal(mapping)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketTelegram).Put(key, data)
+	})
+	if err != nil {
+		logf("[DEBUG] Failed to store IRC message ID: %s\n", err)
+		return nil, false
+	}
+	return mapping, mapping != nil
+}
+
+// DeleteMapping removes the mapping for the given Telegram message and returns it
+func DeleteMapping(chat int64, id int) (*MessageMapping, bool) {
+	if store == nil {
+		return nil, false
+	}
+
+	var mapping *MessageMapping
+	err := store.Update(func(tx *bolt.Tx) error {
+		key := telegramKey(chat, id)
+		data := tx.Bucket(bucketTelegram).Get(key)
+		if data == nil {
+			return nil
+		}
+		mapping = &MessageMapping{}
+		if err := json.Unmarshal(data, mapping); err != nil {
+			mapping = nil
+			return tx.Bucket(bucketTelegram).Delete(key)
+		}
+
+		if ik := mapping.ircKey(); ik != nil {
+			if err := tx.Bucket(bucketIRC).Delete(ik); err != nil {
+				return err
+			}
+		}
+		for _, hk := range mapping.hashKeys() {
+			if bytes.Equal(tx.Bucket(bucketHash).Get(hk), key) {
+				if err := tx.Bucket(bucketHash).Delete(hk); err != nil {
+					return err
+				}
+			}
+		}
+		// Replies to the sender shouldn't target a deleted message
+		if bytes.Equal(tx.Bucket(bucketLatest).Get(mapping.latestKey()), key) {
+			if err := tx.Bucket(bucketLatest).Delete(mapping.latestKey()); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketTelegram).Delete(key)
+	})
+	if err != nil {
+		logf("[DEBUG] Failed to delete message mapping: %s\n", err)
+	}
+	return mapping, mapping != nil
+}
+
+func getMapping(findKey func(tx *bolt.Tx) []byte) (*MessageMapping, bool) {
+	if store == nil {
+		return nil, false
+	}
+
+	var mapping *MessageMapping
+	store.View(func(tx *bolt.Tx) error {
+		key := findKey(tx)
+		if key == nil {
+			return nil
+		}
+		data := tx.Bucket(bucketTelegram).Get(key)
+		if data == nil {
+			return nil
+		}
+		mapping = &MessageMapping{}
+		if err := json.Unmarshal(data, mapping); err != nil {
+			mapping = nil
+		}
+		return nil
+	})
+	return mapping, mapping != nil
+}
+
+// StoreTelegramUser saves the given Telegram user so that IRC users can mention them by name
+func StoreTelegramUser(chat int64, user User) {
+	if store == nil || user.ID == 0 {
+		return
+	}
+
+	data, err := json.Marshal(&user)
+	if err != nil {
+		return
+	}
+	key := userKey(chat, telegramName(user))
+
+	var unchanged bool
+	store.View(func(tx *bolt.Tx) error {
+		unchanged = bytes.Equal(tx.Bucket(bucketUsers).Get(key), data)
+		return nil
+	})
+	if unchanged {
+		return
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).Put(key, data)
+	})
+	if err != nil {
+		logf("[DEBUG] Failed to store Telegram user: %s\n", err)
+	}
+}
+
+// TelegramUserByName finds the Telegram user in the given chat whose IRC name is the given name
+func TelegramUserByName(chat int64, name string) (User, bool) {
+	var user User
+	if store == nil {
+		return user, false
+	}
+
+	var found bool
+	store.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketUsers).Get(userKey(chat, name))
+		if data != nil {
+			found = json.Unmarshal(data, &user) == nil
+		}
+		return nil
+	})
+	return user, found
+}
+
+// MigrateChat moves everything stored for the old Telegram chat ID to the new one,
+// as message mappings, users and polls all refer to the chat by its ID
+func MigrateChat(from, to int64) error {
+	if store == nil {
+		return nil
+	}
+
+	oldPrefix := []byte(fmt.Sprintf("%d:", from))
+	return store.Update(func(tx *bolt.Tx) error {
+		// Keys can't be changed while iterating over the bucket, so the changes are collected first
+		type entry struct{ key, val []byte }
+		collect := func(bucket *bolt.Bucket, change func(key, val []byte) (newKey, newVal []byte)) []entry {
+			var changed []entry
+			bucket.ForEach(func(key, val []byte) error {
+				if newKey, newVal := change(key, val); newKey != nil {
+					changed = append(changed, entry{append([]byte{}, key...), nil}, entry{newKey, newVal})
+				}
+				return nil
+			})
+			return changed
+		}
+		apply := func(bucket *bolt.Bucket, changed []entry) error {
+			for i := 0; i < len(changed); i += 2 {
+				if err := bucket.Delete(changed[i].key); err != nil {
+					return err
+				} else if err = bucket.Put(changed[i+1].key, changed[i+1].val); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		tg := tx.Bucket(bucketTelegram)
+		changed := collect(tg, func(key, data []byte) ([]byte, []byte) {
+			var mapping MessageMapping
+			if !bytes.HasPrefix(key, oldPrefix) || json.Unmarshal(data, &mapping) != nil {
+				return nil, nil
+			}
+			mapping.TelegramChat = to
+			data, err := json.Marshal(&mapping)
+			if err != nil {
+				return nil, nil
+			}
+			return mapping.telegramKey(), data
+		})
+		if err := apply(tg, changed); err != nil {
+			return err
+		}
+
+		// The indexes point to keys in the telegram bucket
+		for _, name := range [][]byte{bucketIRC, bucketHash, bucketLatest} {
+			index := tx.Bucket(name)
+			changed = collect(index, func(key, val []byte) ([]byte, []byte) {
+				if !bytes.HasPrefix(val, oldPrefix) {
+					return nil, nil
+				}
+				return append([]byte{}, key...), []byte(fmt.Sprintf("%d:%s", to, val[len(oldPrefix):]))
+			})
+			if err := apply(index, changed); err != nil {
+				return err
+			}
+		}
+
+		userPrefix := []byte(fmt.Sprintf("%d\x00", from))
+		users := tx.Bucket(bucketUsers)
+		changed = collect(users, func(key, data []byte) ([]byte, []byte) {
+			if !bytes.HasPrefix(key, userPrefix) {
+				return nil, nil
+			}
+			return []byte(fmt.Sprintf("%d\x00%s", to, key[len(userPrefix):])), append([]byte{}, data...)
+		})
+		if err := apply(users, changed); err != nil {
+			return err
+		}
+
+		polls := tx.Bucket(bucketPolls)
+		changed = collect(polls, func(key, data []byte) ([]byte, []byte) {
+			var poll BridgedPoll
+			if json.Unmarshal(data, &poll) != nil || poll.Chat != from {
+				return nil, nil
+			}
+			poll.Chat = to
+			data, err := json.Marshal(&poll)
+			if err != nil {
+				return nil, nil
+			}
+			return append([]byte{}, key...), data
+		})
+		return apply(polls, changed)
+	})
+}
+
+// StorePoll numbers the given poll and saves it as the latest poll of its channel
+func StorePoll(poll *BridgedPoll) error {
+	if store == nil {
+		return fmt.Errorf("message store is not open")
+	}
+	if poll.Created == 0 {
+		poll.Created = time.Now().Unix()
+	}
+
+	return store.Update(func(tx *bolt.Tx) error {
+		number, err := tx.Bucket(bucketPolls).NextSequence()
+		if err != nil {
+			return err
+		}
+		poll.Number = int(number)
+		data, err := json.Marshal(poll)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Bucket(bucketPolls).Put([]byte(poll.Poll.ID), data); err != nil {
+			return err
+		} else if err = tx.Bucket(bucketPollNums).Put(pollNumberKey(poll.Number), []byte(poll.Poll.ID)); err != nil {
+			return err
+		} else if len(poll.OriginalPollID) > 0 {
+			if err = tx.Bucket(bucketPollOrig).Put([]byte(poll.OriginalPollID), []byte(poll.Poll.ID)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketPollLast).Put(latestPollKey(poll.Channel), pollNumberKey(poll.Number))
+	})
+}
+
+// PollByNumber finds the open poll with the given number, or the latest open poll in the channel if the number is 0
+func PollByNumber(channel string, number int) (*BridgedPoll, bool) {
+	if store == nil {
+		return nil, false
+	}
+
+	var poll *BridgedPoll
+	store.View(func(tx *bolt.Tx) error {
+		key := pollNumberKey(number)
+		if number == 0 {
+			key = tx.Bucket(bucketPollLast).Get(latestPollKey(channel))
+		}
+		if id := tx.Bucket(bucketPollNums).Get(key); id != nil {
+			poll = getPoll(tx, id)
+		}
+		return nil
+	})
+	return poll, poll != nil
+}
+
+// PollByOriginal finds the open poll whose original poll sent by a Telegram user has the given ID
+func PollByOriginal(id string) (*BridgedPoll, bool) {
+	if store == nil {
+		return nil, false
+	}
+
+	var poll *BridgedPoll
+	store.View(func(tx *bolt.Tx) error {
+		if copyID := tx.Bucket(bucketPollOrig).Get([]byte(id)); copyID != nil {
+			poll = getPoll(tx, copyID)
+		}
+		return nil
+	})
+	return poll, poll != nil
+}
+
+// PollByMessage finds the open poll for the given Telegram message, which may be either the original poll or the bridge's copy
+func PollByMessage(chat int64, id int) (*BridgedPoll, bool) {
+	if store == nil {
+		return nil, false
+	}
+
+	var poll *BridgedPoll
+	store.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPolls).ForEach(func(key, data []byte) error {
+			var candidate BridgedPoll
+			if json.Unmarshal(data, &candidate) == nil && candidate.Chat == chat &&
+				(candidate.MessageID == id || candidate.OriginalID == id) {
+				poll = &candidate
+			}
+			return nil
+		})
+	})
+	return poll, poll != nil
+}
+
+// UpdatePoll changes the open poll with the given ID using the given function.
+// The poll isn't saved if the function returns an error.
+func UpdatePoll(id string, update func(poll *BridgedPoll) error) (*BridgedPoll, bool, error) {
+	if store == nil {
+		return nil, false, nil
+	}
+
+	var poll *BridgedPoll
+	err := store.Update(func(tx *bolt.Tx) error {
+		if poll = getPoll(tx, []byte(id)); poll == nil {
+			return nil
+		}
+		if err := update(poll); err != nil {
+			return err
+		}
+		data, err := json.Marshal(poll)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketPolls).Put([]byte(id), data)
+	})
+	return poll, poll != nil, err
+}
+
+// RemovePoll removes the open poll with the given ID and returns it
+func RemovePoll(id string) (*BridgedPoll, bool) {
+	if store == nil {
+		return nil, false
+	}
+
+	var poll *BridgedPoll
+	err := store.Update(func(tx *bolt.Tx) error {
+		if poll = getPoll(tx, []byte(id)); poll == nil {
+			return tx.Bucket(bucketPolls).Delete([]byte(id))
+		}
+		return deletePoll(tx, poll)
+	})
+	if err != nil {
+		logf("[DEBUG] Failed to remove poll: %s\n", err)
+	}
+	return poll, poll != nil
+}
+
+func getPoll(tx *bolt.Tx, id []byte) *BridgedPoll {
+	data := tx.Bucket(bucketPolls).Get(id)
+	if data == nil {
+		return nil
+	}
+	poll := &BridgedPoll{}
+	if err := json.Unmarshal(data, poll); err != nil {
+		return nil
+	}
+	return poll
+}
+
+func deletePoll(tx *bolt.Tx, poll *BridgedPoll) error {
+	if len(poll.OriginalPollID) > 0 {
+		if err := tx.Bucket(bucketPollOrig).Delete([]byte(poll.OriginalPollID)); err != nil {
+			return err
+		}
+	}
+	number := pollNumberKey(poll.Number)
+	if err := tx.Bucket(bucketPollNums).Delete(number); err != nil {
+		return err
+	}
+	if bytes.Equal(tx.Bucket(bucketPollLast).Get(latestPollKey(poll.Channel)), number) {
+		if err := tx.Bucket(bucketPollLast).Delete(latestPollKey(poll.Channel)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketPolls).Delete([]byte(poll.Poll.ID))
+}
+
+// CachedMedia is a file that has already been uploaded to a media store
+type CachedMedia struct {
+	URL     string `json:"url"`
+	Created int64  `json:"created"`
+}
+
+func mediaKey(storeName, key string) []byte {
+	return []byte(storeName + "\x00" + key)
+}
+
+// CachedMediaURL finds the URL of a file that has already been uploaded to the given media store.
+// The key is either the Telegram file_unique_id or the hash of the file, prefixed with "id:" or "hash:".
+func CachedMediaURL(storeName, key string) (string, bool) {
+	if store == nil {
+		return "", false
+	}
+
+	var cached CachedMedia
+	var found bool
+	store.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMedia).Get(mediaKey(storeName, key))
+		if data != nil {
+			found = json.Unmarshal(data, &cached) == nil
+		}
+		return nil
+	})
+	if !found {
+		return "", false
+	} else if storeName == StoreLocal {
+		// Files in the local store may have expired or been removed by the cleanup job
+		stat, err := os.Stat(filepath.Join(config.Local.Directory, path.Base(cached.URL)))
+		if err != nil || expired(stat.ModTime()) {
+			return "", false
+		}
+	} else if cachedExpired(storeName, cached) {
+		return "", false
+	}
+	return cached.URL, true
+}
+
+// cachedExpired checks if the file of a cache entry has been removed from the media store
+func cachedExpired(storeName string, cached CachedMedia) bool {
+	expiry := mediaExpiry(storeName)
+	return expiry > 0 && time.Since(time.Unix(cached.Created, 0)) > expiry
+}
+
+// CacheMediaURL saves the URL of an uploaded file with the given keys
+func CacheMediaURL(storeName, url string, keys ...string) {
+	if store == nil || len(keys) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(&CachedMedia{URL: url, Created: time.Now().Unix()})
+	if err != nil {
+		return
+	}
+	err = store.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := tx.Bucket(bucketMedia).Put(mediaKey(storeName, key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logf("[DEBUG] Failed to cache media URL: %s\n", err)
+	}
+}
+
+func pruneLoop() {
+	for {
+		pruneStore()
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+// pruneStore removes mappings, cached media URLs and polls older than the configured max age
+func pruneStore() {
+	maxAge := config.Store.MaxAge
+	if maxAge <= 0 {
+		maxAge = 7 * 24
+	}
+	cutoff := time.Now().Add(-time.Duration(maxAge) * time.Hour).Unix()
+
+	var pruned int
+	err := store.Update(func(tx *bolt.Tx) error {
+		tg := tx.Bucket(bucketTelegram)
+		var old [][]byte
+		tg.ForEach(func(key, data []byte) error {
+			var mapping MessageMapping
+			if err := json.Unmarshal(data, &mapping); err == nil && mapping.Created >= cutoff {
+				return nil
+			}
+			// Index entries may have been taken over by a newer message with the same ID or text
+			if ik := mapping.ircKey(); ik != nil && bytes.Equal(tx.Bucket(bucketIRC).Get(ik), key) {
+				tx.Bucket(bucketIRC).Delete(ik)
+			}
+			for _, hk := range mapping.hashKeys() {
+				if bytes.Equal(tx.Bucket(bucketHash).Get(hk), key) {
+					tx.Bucket(bucketHash).Delete(hk)
+				}
+			}
+			old = append(old, append([]byte{}, key...))
+			return nil
+		})
+		// Keys can't be deleted while iterating over the bucket
+		for _, key := range old {
+			if err := tg.Delete(key); err != nil {
+				return err
+			}
+		}
+		pruned = len(old)
+
+		// Index entries that aren't in a mapping, like the IDs of later lines of multi-line messages,
+		// are removed once the mapping they point to is gone
+		for _, name := range [][]byte{bucketLatest, bucketIRC, bucketHash} {
+			index := tx.Bucket(name)
+			var stale [][]byte
+			index.ForEach(func(key, val []byte) error {
+				if tg.Get(val) == nil {
+					stale = append(stale, append([]byte{}, key...))
+				}
+				return nil
+			})
+			for _, key := range stale {
+				if err := index.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+
+		media := tx.Bucket(bucketMedia)
+		var uncached [][]byte
+		media.ForEach(func(key, data []byte) error {
+			var cached CachedMedia
+			storeName := strings.SplitN(string(key), "\x00", 2)[0]
+			if err := json.Unmarshal(data, &cached); err != nil || cached.Created < cutoff || cachedExpired(storeName, cached) {
+				uncached = append(uncached, append([]byte{}, key...))
+			}
+			return nil
+		})
+		for _, key := range uncached {
+			if err := media.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		// Polls that never closed stop being counted once they're too old to reply to
+		var abandoned []*BridgedPoll
+		tx.Bucket(bucketPolls).ForEach(func(key, data []byte) error {
+			var poll BridgedPoll
+			if err := json.Unmarshal(data, &poll); err != nil {
+				poll.Poll.ID = string(key)
+			} else if poll.Created >= cutoff {
+				return nil
+			}
+			abandoned = append(abandoned, &poll)
+			return nil
+		})
+		for _, poll := range abandoned {
+			if err := deletePoll(tx, poll); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logf("[DEBUG] Failed to prune message store: %s\n", err)
+	} else if pruned > 0 {
+		logf("[DEBUG] Pruned %d old message mappings\n", pruned)
+	}
+}
@@ -0,0 +1,156 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestStore opens an empty message store in a temporary directory
+func openTestStore(t *testing.T) {
+	var err error
+	store, err = bolt.Open(filepath.Join(t.TempDir(), "messages.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx *bolt.Tx) error {
+		for _, name := range storeBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closeTestStore() {
+	closeStore()
+	store = nil
+}
+
+func TestMigrateChat(t *testing.T) {
+	openTestStore(t)
+	defer closeTestStore()
+
+	StoreMapping(&MessageMapping{TelegramChat: -1, TelegramID: 5, IRCChannel: "#chan", IRCMsgID: "abc", IRCNick: "alice", LineHashes: []string{TextHash("<alice> hi")}})
+	StoreMapping(&MessageMapping{TelegramChat: -10, TelegramID: 6, IRCChannel: "#other", IRCNick: "bob", LineHashes: []string{TextHash("<bob> hi")}})
+	StoreTelegramUser(-1, User{ID: 1, FirstName: "alice"})
+	poll := &BridgedPoll{Poll: Poll{ID: "p"}, Chat: -1, MessageID: 7, Channel: "#chan"}
+	if err := StorePoll(poll); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateChat(-1, -1001); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := MappingByTelegram(-1, 5); ok {
+		t.Error("mapping still stored under the old chat")
+	}
+	if mapping, ok := MappingByTelegram(-1001, 5); !ok || mapping.TelegramChat != -1001 {
+		t.Errorf("mapping not moved to the new chat: %+v", mapping)
+	}
+	if mapping, ok := MappingByIRC("#chan", "abc"); !ok || mapping.TelegramChat != -1001 {
+		t.Errorf("IRC index not moved to the new chat: %+v", mapping)
+	}
+	if mapping, ok := LatestByNick("#chan", "alice"); !ok || mapping.TelegramChat != -1001 {
+		t.Errorf("latest index not moved to the new chat: %+v", mapping)
+	}
+	if mapping, ok := MappingByLine("#chan", "<alice> hi"); !ok || mapping.TelegramChat != -1001 {
+		t.Errorf("hash index not moved to the new chat: %+v", mapping)
+	}
+	if mapping, ok := MappingByTelegram(-10, 6); !ok || mapping.TelegramChat != -10 {
+		t.Errorf("mapping of another chat changed: %+v", mapping)
+	}
+	if _, ok := TelegramUserByName(-1001, "alice"); !ok {
+		t.Error("user not moved to the new chat")
+	} else if _, ok = TelegramUserByName(-1, "alice"); ok {
+		t.Error("user still stored under the old chat")
+	}
+	if found, ok := PollByMessage(-1001, 7); !ok || found.Number != poll.Number {
+		t.Errorf("poll not moved to the new chat: %+v", found)
+	}
+
+	var entries int
+	store.View(func(tx *bolt.Tx) error {
+		entries = tx.Bucket(bucketTelegram).Stats().KeyN
+		return nil
+	})
+	if entries != 2 {
+		t.Errorf("expected 2 mappings after migration, got %d", entries)
+	}
+}
+
+func TestStoreIRCMsgID(t *testing.T) {
+	openTestStore(t)
+	defer closeTestStore()
+
+	lines := []string{"<alice> first", "<alice> second"}
+	StoreMapping(&MessageMapping{TelegramChat: -1, TelegramID: 5, IRCChannel: "#chan", IRCNick: "alice", LineHashes: lineHashes(lines)})
+
+	if _, ok := StoreIRCMsgID("#chan", "<alice> unknown", "x"); ok {
+		t.Error("found mapping for a line that wasn't sent")
+	}
+	if _, ok := StoreIRCMsgID("#other", lines[0], "x"); ok {
+		t.Error("found mapping for a line in another channel")
+	}
+	if mapping, ok := StoreIRCMsgID("#chan", lines[0], "id1"); !ok || mapping.IRCMsgID != "id1" {
+		t.Errorf("first line not mapped: %+v", mapping)
+	}
+	if mapping, ok := StoreIRCMsgID("#chan", lines[1], "id2"); !ok || mapping.IRCMsgID != "id1" {
+		t.Errorf("second line changed the message ID of the mapping: %+v", mapping)
+	}
+
+	for _, msgid := range []string{"id1", "id2"} {
+		if id := replyTarget("#chan", "hi", map[string]string{"+draft/reply": msgid}); id != 5 {
+			t.Errorf("reply to %s targets %d, expected 5", msgid, id)
+		}
+	}
+	if _, ok := DeleteMapping(-1, 5); !ok {
+		t.Fatal("mapping not deleted")
+	}
+	if _, ok := MappingByIRC("#chan", "id1"); ok {
+		t.Error("deleted mapping still found by message ID")
+	}
+}
+
+func TestPollByOriginal(t *testing.T) {
+	openTestStore(t)
+	defer closeTestStore()
+
+	poll := &BridgedPoll{Poll: Poll{ID: "copy"}, OriginalPollID: "original", Chat: -1, Channel: "#chan"}
+	if err := StorePoll(poll); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := PollByOriginal("original"); !ok || found.Poll.ID != "copy" {
+		t.Errorf("poll not found by original ID: %+v", found)
+	}
+	if _, ok := PollByOriginal("copy"); ok {
+		t.Error("poll found by the ID of the copy")
+	}
+	if _, ok := RemovePoll("copy"); !ok {
+		t.Fatal("poll not removed")
+	}
+	if _, ok := PollByOriginal("original"); ok {
+		t.Error("removed poll still found by original ID")
+	}
+}
@@ -16,20 +16,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/tucnak/telebot"
 )
 
-// GoogleMaps ...
-const GoogleMaps = "https://maps.google.com/maps?q=%[1]f,%[2]f&ll=%[1]f,%[2]f&z=16"
-
-// Contact ...
-const Contact = "%[1]s %[2]s (%[3]s)"
-
-// SimpleUser is a simple wrapper for telebots Recepient
+// SimpleUser contains the ID of a Telegram chat
 type SimpleUser struct {
 	Sender string
 }
@@ -39,27 +39,22 @@ func (su SimpleUser) Destination() string {
 	return su.Sender
 }
 
-var telegram *telebot.Bot
+// botUser is the Telegram user of the bridge bot
+var botUser User
 
 var groupSU SimpleUser
-var md *telebot.SendOptions
-
-func init() {
-	md = new(telebot.SendOptions)
-	md.ParseMode = telebot.ModeMarkdown
-}
 
 func startTelegram() {
 	// Connect to Telegram
 	var err error
-	telegram, err = telebot.NewBot(config.Telegram.Token)
+	botUser, err = GetMe()
 	if err != nil {
 		logf("[DEBUG] Error connecting to Telegram: %[1]s\n", err)
 		return
 	}
-	messages := make(chan telebot.Message)
+	messages := make(chan Message)
 	// Enable message listener
-	telegram.Listen(messages, 1*time.Second)
+	go listen(messages)
 	// Print "connected" message
 	logf("[DEBUG] Successfully connected to Telegram!\n")
 
@@ -69,69 +64,273 @@ func startTelegram() {
 	}
 }
 
-func misUpload(text, fileID string) string {
-	dl := CreateDownload(fileID)
-	if len(dl) == 0 {
-		return text
+// errNoMediaStore is returned by uploadFile if the IRC channel has no media store
+var errNoMediaStore = errors.New("no media store configured")
+
+// uploadFile downloads the given Telegram file and uploads it to the media store of the IRC channel
+// the message is bridged to. If the file has no mime type, it is detected from the data. Files
+// larger than maxSize bytes are not downloaded. Files that have already been uploaded to the
+// same store are not uploaded again. Cancelling the context aborts the download and upload.
+func uploadFile(ctx context.Context, message Message, file Attachment, maxSize int) (string, error) {
+	channel, ok := config.GetIRCChannel(strconv.FormatInt(message.Chat.ID, 10))
+	if !ok {
+		return "", errNoMediaStore
 	}
-	data := Download(dl)
-	if len(data) == 0 {
-		return text
+	storeName, store, ok := GetMediaStore(channel)
+	if !ok {
+		return "", errNoMediaStore
 	}
-	url := MISUpload(data)
-	if len(url) == 0 {
-		return text
+
+	var cacheKeys []string
+	if len(file.FileUniqueID) > 0 {
+		cacheKeys = append(cacheKeys, "id:"+file.FileUniqueID)
+		if url, ok := CachedMediaURL(storeName, cacheKeys[0]); ok {
+			return url, nil
+		}
 	}
-	text = fmt.Sprintf("%s %s", url, text)
-	return text
+
+	ctx, cancel := context.WithTimeout(ctx, downloadAttempts*downloadTimeout)
+	defer cancel()
+	dl, err := CreateDownload(ctx, file.FileID, int64(maxSize))
+	if err != nil {
+		return "", err
+	}
+	data, size, err := Download(ctx, dl, int64(maxSize))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	if hash, err := fileHash(data); err == nil {
+		if url, ok := CachedMediaURL(storeName, "hash:"+hash); ok {
+			CacheMediaURL(storeName, url, cacheKeys...)
+			return url, nil
+		}
+		cacheKeys = append(cacheKeys, "hash:"+hash)
+	}
+
+	url, err := uploadData(ctx, store, data, size, file.Mime)
+	if err == nil {
+		CacheMediaURL(storeName, url, cacheKeys...)
+	}
+	return url, err
 }
 
-func telegramMessageData(message telebot.Message) telebot.Message {
-	if len(message.Photo) > 0 && len(config.MIS.Username) > 0 {
-		message.Text = misUpload(message.Text, message.Photo[len(message.Photo)-1].FileID)
-	} else if message.Sticker.Exists() {
-		message.Text = misUpload(message.Text, message.Sticker.FileID)
-	} else if message.Location.Latitude != 0 || message.Location.Longitude != 0 {
-		message.Text = fmt.Sprintf(GoogleMaps, message.Location.Latitude, message.Location.Longitude)
-	} else if message.Contact.UserID != 0 {
-		message.Text = fmt.Sprintf(Contact, message.Contact.FirstName, message.Contact.LastName, message.Contact.PhoneNumber)
-	} else if message.Document.Exists() && message.Document.Mime == "image/gif" {
-		message.Text = misUpload(message.Text, message.Document.FileID)
+// uploadData uploads the given file to the store. Images are processed before uploading.
+func uploadData(ctx context.Context, store MediaStore, file *os.File, size int64, mime string) (string, error) {
+	if len(mime) == 0 {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		mime = http.DetectContentType(head[:n])
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if strings.HasPrefix(mime, "image/") {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return "", err
+		}
+		data, mime = processImage(data, mime, store)
+		return store.Upload(ctx, bytes.NewReader(data), int64(len(data)), mime)
+	}
+	return store.Upload(ctx, file, size, mime)
+}
+
+func telegramMessageData(message Message) Message {
+	if message.Location.Exists() {
+		message.Text = locationText(message)
+	} else if message.Contact.Exists() {
+		message.Text = contactText(message)
 	}
 	return message
 }
 
-func telegramUsername(message telebot.Message) string {
-	if len(message.Sender.Username) > 0 {
-		return message.Sender.Username
-	} else if len(message.Sender.FirstName) > 0 {
-		return message.Sender.FirstName
-	} else if len(message.Sender.LastName) > 0 {
-		return message.Sender.LastName
+func telegramUsername(message Message) string {
+	return telegramName(message.Sender)
+}
+
+// telegramName returns the name used for the given Telegram user on IRC
+func telegramName(user User) string {
+	if len(user.Username) > 0 {
+		return user.Username
+	} else if len(user.FirstName) > 0 {
+		return user.FirstName
+	} else if len(user.LastName) > 0 {
+		return user.LastName
 	}
-	return strconv.Itoa(message.Sender.ID)
+	return strconv.Itoa(user.ID)
 }
 
-func telegramMessage(message telebot.Message) {
+// replyName returns the name of the sender of the message being replied to.
+// Replies to messages the bridge relayed from IRC use the original IRC nick.
+func replyName(message Message) string {
+	if mapping, ok := MappingByTelegram(message.Chat.ID, message.ReplyTo.ID); ok && mapping.FromIRC {
+		return mapping.IRCNick
+	}
+	return telegramName(message.ReplyTo.Sender)
+}
+
+// ircReplyName returns the name of the sender of the message being replied to as it's written on IRC.
+// Telegram names are protected from highlighting IRC users with the same nick,
+// but IRC nicks are kept as they are so that replies highlight the IRC user.
+func ircReplyName(message Message) string {
+	if mapping, ok := MappingByTelegram(message.Chat.ID, message.ReplyTo.ID); ok && mapping.FromIRC {
+		return mapping.IRCNick
+	}
+	channel, _ := config.GetIRCChannel(strconv.FormatInt(message.Chat.ID, 10))
+	return formatNick(channel, telegramName(message.ReplyTo.Sender))
+}
+
+// replyExcerpt returns a truncated quote of the message being replied to
+func replyExcerpt(message Message) string {
+	length := config.IRC.ReplyQuote
+	if length < 0 {
+		return ""
+	} else if length == 0 {
+		length = 50
+	}
+
+	text := message.ReplyTo.Text
+	if mapping, ok := MappingByTelegram(message.Chat.ID, message.ReplyTo.ID); ok && mapping.FromIRC {
+		// Messages relayed from IRC are prefixed with the sender's nick
+		text = strings.TrimPrefix(text, fmt.Sprintf("<%s> ", mapping.IRCNick))
+		text = strings.TrimPrefix(text, fmt.Sprintf("★ %s ", mapping.IRCNick))
+	}
+	if len(text) == 0 {
+		return mediaPlaceholder(*message.ReplyTo)
+	}
+
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > length {
+		text = string(runes[:length]) + "…"
+	}
+	return fmt.Sprintf("\"%s\"", text)
+}
+
+// mediaPlaceholder returns a short description of the media in the given message
+func mediaPlaceholder(message Message) string {
+	if message.Audio.Exists() {
+		return "[audio]"
+	} else if message.Voice.Exists() {
+		return "[voice]"
+	} else if message.VideoNote.Exists() {
+		return "[video note]"
+	} else if message.Video.Exists() {
+		return "[video]"
+	} else if len(message.Photo) > 0 {
+		return "[photo]"
+	} else if message.Sticker.Exists() {
+		return "[sticker]"
+	} else if message.Document.Exists() {
+		return "[file]"
+	} else if len(message.Venue.Title) > 0 {
+		return "[venue]"
+	} else if message.Location.Exists() {
+		return "[location]"
+	} else if message.Contact.Exists() {
+		return "[contact]"
+	} else if message.Poll.Exists() {
+		return "[" + pollKind(message.Poll) + "]"
+	}
+	return "[message]"
+}
+
+// Kinds of Telegram messages that are handled differently
+const (
+	kindEdit       = "edit"
+	kindMigration  = "migration"
+	kindDelete     = "delete"
+	kindClosePoll  = "closepoll"
+	kindMembership = "membership"
+	kindChatEvent  = "chatevent"
+	kindAlbum      = "album"
+	kindPoll       = "poll"
+	kindMedia      = "media"
+	kindText       = "text"
+)
+
+// messageKind returns how the given message should be handled. Commands are checked before anything else
+// that could relay the message, as the messages commands reply to shouldn't end up on IRC.
+func messageKind(message Message) string {
+	if message.IsEdit {
+		return kindEdit
+	} else if message.MigrateTo != 0 || message.MigrateFrom != 0 {
+		return kindMigration
+	} else if isCommand(message, DeleteCommand) {
+		return kindDelete
+	} else if isCommand(message, ClosePollCommand) {
+		return kindClosePoll
+	} else if isMembershipEvent(message) {
+		return kindMembership
+	} else if isChatEvent(message) {
+		return kindChatEvent
+	} else if len(message.MediaGroupID) > 0 {
+		return kindAlbum
+	} else if message.Poll.Exists() {
+		return kindPoll
+	} else if _, _, ok := mediaFile(message); ok {
+		return kindMedia
+	}
+	return kindText
+}
+
+func telegramMessage(message Message) {
+	kind := messageKind(message)
+	if kind != kindEdit {
+		StoreTelegramUser(message.Chat.ID, message.Sender)
+	}
+	switch kind {
+	case kindEdit:
+		telegramEdit(message)
+		return
+	case kindMigration:
+		telegramMigrate(message)
+		return
+	case kindDelete:
+		telegramDeleteCommand(message)
+		return
+	case kindClosePoll:
+		telegramClosePoll(message)
+		return
+	case kindMembership:
+		telegramMembership(message)
+		return
+	case kindChatEvent:
+		telegramChatEvent(message)
+		return
+	case kindAlbum:
+		bufferAlbum(message)
+		return
+	case kindPoll:
+		telegramPoll(message)
+		return
+	case kindMedia:
+		file, kind, _ := mediaFile(message)
+		telegramMedia(message, file, kind)
+		return
+	}
 	message = telegramMessageData(message)
 	if len(message.Text) == 0 {
-		telegramLog(message)
+		telegramLog(message, "")
 		return
 	}
 	if message.IsForwarded() {
-		// Type>ID|Timestamp|Username|UID|Text||ForwardTimestamp|ForwardUsername|ForwardUID
-		logf("FORWARD>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s§%[6]d|%[7]s|%[8]d\n",
+		origin := message.Origin()
+		// Type>ID|Timestamp|Username|UID|Text||ForwardTimestamp|ForwardName|ForwardID|ForwardType
+		logf("FORWARD>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s§%[6]d|%[7]s|%[8]d|%[9]s\n",
 			message.ID,
 			message.Time().Unix(),
 			telegramUsername(message),
 			message.Sender.ID,
 			message.Text,
-			message.OriginalUnixtime,
-			message.OriginalSender.Username,
-			message.OriginalSender.ID,
+			origin.Date,
+			origin.Name(),
+			origin.ID(),
+			origin.Type,
 		)
-		ircmessage(message.Chat.ID, telegramUsername(message), fmt.Sprintf("[fwd from %[2]s] %[1]s", message.Text, message.OriginalSender.Username))
-	} else if message.IsReply() {
+	} else if message.ReplyTo != nil {
 		// Type>ID|Timestamp|Username|UID|Text||ReplyID|ReplyTimestamp|ReplyUsername|ReplyUID|ReplyText
 		logf("REPLY>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s§%[6]d|%[7]d|%[8]s|%[9]d|%[10]s\n",
 			message.ID,
@@ -141,11 +340,10 @@ func telegramMessage(message telebot.Message) {
 			message.Text,
 			message.ReplyTo.ID,
 			message.ReplyTo.Time().Unix(),
-			message.ReplyTo.Sender.Username,
+			replyName(message),
 			message.ReplyTo.Sender.ID,
 			message.ReplyTo.Text,
 		)
-		ircmessage(message.Chat.ID, telegramUsername(message), fmt.Sprintf("[reply to %[2]s] %[1]s", message.Text, message.ReplyTo.Sender.Username))
 	} else {
 		// Type>ID|Timestamp|Username|UID|Text
 		logf("MESSAGE>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s\n",
@@ -155,46 +353,104 @@ func telegramMessage(message telebot.Message) {
 			message.Sender.ID,
 			message.Text,
 		)
-		ircmessage(message.Chat.ID, telegramUsername(message), message.Text)
 	}
+	relay(message, telegramUsername(message), ircPrefix(message)+telegramMentions(message))
+}
+
+// telegramEdit handles edited messages. Only live location updates are relayed.
+func telegramEdit(message Message) {
+	if message.Location.Exists() && message.Location.LivePeriod > 0 {
+		telegramLiveLocation(message)
+	}
+}
+
+// telegramMedia uploads the file in the message and relays it to IRC along with the caption
+func telegramMedia(message Message, file Attachment, kind string) {
+	if asyncMedia(message, file, kind) {
+		relayMediaAsync(message, file, kind)
+		return
+	}
+
+	text, url := relayMedia(context.Background(), message, file, kind)
+	telegramLog(message, url)
+	if caption := telegramCaption(message); len(caption) > 0 {
+		text = fmt.Sprintf("%s %s", text, caption)
+	}
+	relay(message, telegramUsername(message), ircPrefix(message)+text)
+}
+
+// ircPrefix returns the forward or reply prefix for a message relayed to IRC
+func ircPrefix(message Message) string {
+	if message.IsForwarded() {
+		channel, _ := config.GetIRCChannel(strconv.FormatInt(message.Chat.ID, 10))
+		return fmt.Sprintf("[fwd from %s] ", formatNick(channel, message.Origin().Name()))
+	} else if message.ReplyTo != nil {
+		if excerpt := replyExcerpt(message); len(excerpt) > 0 {
+			return fmt.Sprintf("[reply to %s: %s] ", ircReplyName(message), excerpt)
+		}
+		return fmt.Sprintf("[reply to %s] ", ircReplyName(message))
+	}
+	return ""
+}
+
+// relay sends the given text to IRC and records the message mapping
+func relay(message Message, user, text string) {
+	channel, ok := ircmessage(message.Chat.ID, user, text)
+	if !ok {
+		return
+	}
+	StoreMapping(&MessageMapping{
+		TelegramChat: message.Chat.ID,
+		TelegramID:   message.ID,
+		IRCChannel:   channel,
+		IRCNick:      user,
+		IRCTime:      time.Now().Unix(),
+		LineHashes:   lineHashes(ircLines(channel, user, text)),
+	})
+}
+
+// lineHashes returns the hashes of the given IRC lines
+func lineHashes(lines []string) []string {
+	hashes := make([]string, len(lines))
+	for i, line := range lines {
+		hashes[i] = TextHash(line)
+	}
+	return hashes
 }
 
-func telegramLog(message telebot.Message) {
+// telegramLog logs a message that doesn't contain text. If the message contains media,
+// url is the link to the uploaded file.
+func telegramLog(message Message, url string) {
 	if message.Audio.Exists() {
 		message.Text = "DATA_AUDIO"
+	} else if message.Voice.Exists() {
+		message.Text = "DATA_VOICE"
+	} else if message.VideoNote.Exists() {
+		message.Text = "DATA_VIDEO_NOTE"
 	} else if message.Video.Exists() {
 		message.Text = "DATA_VIDEO"
 	} else if len(message.Photo) > 0 {
 		message.Text = "DATA_PHOTO"
 	} else if message.Sticker.Exists() {
 		message.Text = "DATA_STICKER"
-	} else if message.UserJoined.ID != 0 {
-		// Type>ID|Timestamp|Username|UID
-		logf("JOIN>%[1]d|%[2]d|%[3]s|%[4]d\n",
-			message.ID,
-			message.Time().Unix(),
-			message.UserJoined.Username,
-			message.UserJoined.ID,
-		)
-		ircmessage(message.Chat.ID, telegramUsername(message), "* joined the group")
-		return
-	} else if message.UserLeft.ID != 0 {
-		// Type>ID|Timestamp|Username|UID
-		logf("LEAVE>%[1]d|%[2]d|%[3]s|%[4]d\n",
-			message.ID,
-			message.Time().Unix(),
-			message.UserJoined.Username,
-			message.UserJoined.ID,
-		)
-		ircmessage(message.Chat.ID, telegramUsername(message), "* left the group")
-		return
-	} else if len(message.NewChatTitle) > 0 {
-		message.Text = "Group title changed to " + message.NewChatTitle
 	} else if message.Document.Exists() {
 		message.Text = "DATA_DOCUMENT-" + message.Document.Mime
 	} else {
 		message.Text = "DATA_UNKNOWN"
 	}
+	if len(url) > 0 || len(message.Caption) > 0 {
+		// Type>ID|Timestamp|Username|UID|Text||URL|Caption
+		logf("DATA>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s§%[6]s|%[7]s\n",
+			message.ID,
+			message.Time().Unix(),
+			telegramUsername(message),
+			message.Sender.ID,
+			message.Text,
+			url,
+			message.Caption,
+		)
+		return
+	}
 	// Type>ID|Timestamp|Username|UID|Text
 	logf("DATA>%[1]d|%[2]d|%[3]s|%[4]d|%[5]s\n",
 		message.ID,
@@ -0,0 +1,79 @@
+// tgirc-bridge - A Telegram <-> IRC bridge and chat logger
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import "testing"
+
+func TestMessageKind(t *testing.T) {
+	botUser.Username = "bridgebot"
+	defer func() { botUser.Username = "" }()
+	secret := &Message{ID: 1, Text: "my secret", Sender: User{ID: 2, FirstName: "Eve"}}
+	file := Attachment{FileInfo: FileInfo{FileID: "file"}}
+	tests := []struct {
+		name    string
+		message Message
+		kind    string
+	}{
+		{"text", Message{Text: "hello"}, kindText},
+		{"reply", Message{Text: "hello", ReplyTo: secret}, kindText},
+		{"delete command", Message{Text: "/delete", ReplyTo: secret}, kindDelete},
+		{"delete command without reply", Message{Text: "/delete"}, kindDelete},
+		{"delete command to the bridge", Message{Text: "/delete@BridgeBot", ReplyTo: secret}, kindDelete},
+		{"delete command to another bot", Message{Text: "/delete@otherbot", ReplyTo: secret}, kindText},
+		{"close poll command", Message{Text: "/closepoll", ReplyTo: secret}, kindClosePoll},
+		{"edited delete command", Message{Text: "/delete", ReplyTo: secret, IsEdit: true}, kindEdit},
+		{"migration", Message{MigrateTo: -100}, kindMigration},
+		{"join", Message{NewChatMembers: []User{{ID: 3}}}, kindMembership},
+		{"pin", Message{PinnedMessage: secret}, kindChatEvent},
+		{"album", Message{MediaGroupID: "1", Photo: []PhotoSize{{FileInfo: FileInfo{FileID: "p"}}}}, kindAlbum},
+		{"poll", Message{Poll: Poll{ID: "p"}}, kindPoll},
+		{"document", Message{Document: file}, kindMedia},
+	}
+	for _, test := range tests {
+		if kind := messageKind(test.message); kind != test.kind {
+			t.Errorf("%s: got %s, expected %s", test.name, kind, test.kind)
+		}
+	}
+}
+
+func TestIRCPrefix(t *testing.T) {
+	openTestStore(t)
+	defer closeTestStore()
+	config = &Config{
+		Mappings:       map[string]string{"#chan": "-1"},
+		MappingOptions: map[string]MappingOptions{"#chan": {NickProtection: ProtectZWSP}},
+	}
+	config.IRC.ReplyQuote = -1
+	defer func() { config = nil }()
+	StoreMapping(&MessageMapping{TelegramChat: -1, TelegramID: 2, IRCChannel: "#chan", IRCNick: "john", FromIRC: true})
+
+	john := User{ID: 1, Username: "john"}
+	tests := []struct {
+		name     string
+		message  Message
+		expected string
+	}{
+		{"reply to Telegram user", Message{Chat: Chat{ID: -1}, ReplyTo: &Message{ID: 1, Sender: john}}, "[reply to j\u200bohn] "},
+		{"reply to IRC user", Message{Chat: Chat{ID: -1}, ReplyTo: &Message{ID: 2, Sender: botUser}}, "[reply to john] "},
+		{"forward", Message{Chat: Chat{ID: -1}, ForwardOrigin: &MessageOrigin{Type: OriginUser, SenderUser: User{ID: 1, FirstName: "john"}}}, "[fwd from j\u200bohn] "},
+		{"plain", Message{Chat: Chat{ID: -1}}, ""},
+	}
+	for _, test := range tests {
+		if prefix := ircPrefix(test.message); prefix != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, prefix, test.expected)
+		}
+	}
+}